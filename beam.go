@@ -0,0 +1,90 @@
+package infinigram
+
+import (
+	"bytes"
+	"index/suffixarray"
+	"math"
+	"sort"
+)
+
+// beam is one candidate continuation in GenerateBeam.
+type beam struct {
+	text  []byte
+	score float64 // natural-log probability of the generated bytes
+}
+
+// GenerateBeam decodes with beam search: it keeps the beamWidth most probable
+// continuations of prompt, scored by cumulative log-probability under the normalized
+// combined distribution (temperature 1), and returns the best finished one with its
+// score. Each step expands every beam with its beamWidth most likely next bytes and
+// keeps the beamWidth best of the results, so work is bounded by beamWidth² candidates
+// per step. Each beam matches against its own trailing context window.
+//
+// A beam finishes when it reaches maxChars or when no suffix of its context matches.
+// Finished beams are compared by log-probability per generated byte, so one that hit a
+// dead end early doesn't win just for being short. It returns prompt and 0 if nothing
+// can be generated. A beamWidth below 1 is treated as 1, which is greedy decoding.
+func GenerateBeam(idx *suffixarray.Index, prompt string, maxChars, beamWidth, k int) (string, float64) {
+	beamWidth = max(beamWidth, 1)
+	var cfg *Config // default context window
+	beams := []beam{{text: []byte(prompt)}}
+	var finished []beam
+	for len(beams) > 0 {
+		var next []beam
+		for _, b := range beams {
+			if len(b.text) >= maxChars {
+				finished = append(finished, b)
+				continue
+			}
+			dist, _, _ := BuildDistribution(idx, string(cfg.context(b.text)), k, cfg)
+			if dist == nil {
+				finished = append(finished, b)
+				continue
+			}
+			for _, c := range topCandidates(dist, beamWidth) {
+				text := append(bytes.Clone(b.text), c.ch)
+				next = append(next, beam{text, b.score + math.Log(c.p)})
+			}
+		}
+		sort.SliceStable(next, func(i, j int) bool {
+			return next[i].score > next[j].score
+		})
+		beams = next[:min(len(next), beamWidth)]
+	}
+
+	best, bestAvg := beam{text: []byte(prompt)}, math.Inf(-1)
+	for _, b := range finished {
+		if n := len(b.text) - len(prompt); n > 0 && b.score/float64(n) > bestAvg {
+			best, bestAvg = b, b.score/float64(n)
+		}
+	}
+	return string(best.text), best.score
+}
+
+// candidate is a next byte and its normalized probability.
+type candidate struct {
+	ch byte
+	p  float64
+}
+
+// topCandidates returns the n most likely bytes of dist, normalized, most likely
+// first with ties broken by byte value.
+func topCandidates(dist map[byte]float64, n int) []candidate {
+	var total float64
+	cands := make([]candidate, 0, len(dist))
+	for ch, w := range dist {
+		total += w
+		cands = append(cands, candidate{ch, w})
+	}
+	sort.Slice(cands, func(i, j int) bool {
+		if cands[i].p != cands[j].p {
+			return cands[i].p > cands[j].p
+		}
+		return cands[i].ch < cands[j].ch
+	})
+	cands = cands[:min(len(cands), n)]
+	for i := range cands {
+		cands[i].p /= total
+	}
+	return cands
+}
@@ -0,0 +1,31 @@
+package infinigram
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGenerateBeam(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	for _, prompt := range []string{"the ", "a cat", "the dog ran"} {
+		// Width 1 keeps only the most likely byte at each step, like greedy decoding
+		got, score := GenerateBeam(idx, prompt, 60, 1, 3)
+		want, _ := Generate(idx, prompt, 60, 0, 3)
+		if got != want {
+			t.Errorf("width 1 from %q generated %q, temp-0 Generate %q", prompt, got, want)
+		}
+		// and its score is the log probability of that path
+		var logProb float64
+		for i := len(prompt); i < len(got); i++ {
+			dist, _, _ := NextDistribution(idx, got[:i], 1, 3)
+			logProb += math.Log(dist[got[i]])
+		}
+		if math.Abs(score-logProb) > 1e-9*math.Abs(logProb) {
+			t.Errorf("width 1 from %q scored %v, want %v", prompt, score, logProb)
+		}
+	}
+
+	if got, score := GenerateBeam(idx, "q", 60, 4, 3); got != "q" || score != 0 {
+		t.Errorf("unmatched prompt gave %q with score %v, want the prompt with 0", got, score)
+	}
+}
@@ -0,0 +1,45 @@
+package infinigram
+
+import "container/list"
+
+// lruCache is a bounded least-recently-used cache keyed by string.
+// It is not safe for concurrent use.
+type lruCache[V any] struct {
+	capacity int
+	order    *list.List // front is most recently used
+	items    map[string]*list.Element
+}
+
+type lruEntry[V any] struct {
+	key   string
+	value V
+}
+
+func newLRUCache[V any](capacity int) *lruCache[V] {
+	return &lruCache[V]{capacity: capacity, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// get returns the value cached for key and marks it as recently used.
+func (c *lruCache[V]) get(key string) (V, bool) {
+	if e, ok := c.items[key]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*lruEntry[V]).value, true
+	}
+	var zero V
+	return zero, false
+}
+
+// put caches value for key, evicting the least recently used entry if full.
+func (c *lruCache[V]) put(key string, value V) {
+	if e, ok := c.items[key]; ok {
+		e.Value.(*lruEntry[V]).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+	if c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry[V]).key)
+	}
+	c.items[key] = c.order.PushFront(&lruEntry[V]{key, value})
+}
@@ -0,0 +1,131 @@
+package infinigram
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"index/suffixarray"
+	"io"
+	"os"
+)
+
+// chunkOverlap is how many bytes past its own region each chunk also indexes, so that
+// queries of up to chunkOverlap bytes (with their continuation) that straddle a chunk
+// boundary are still found. It exceeds the default 200-byte generation context window.
+const chunkOverlap = 256
+
+// ChunkedModel indexes a corpus as a series of independently built suffix arrays so
+// that no single index has to hold the whole file. Queries fan out to every chunk and
+// the results are merged.
+type ChunkedModel struct {
+	chunks []*suffixarray.Index
+	// owned[i] is how many leading bytes of chunk i belong to it; the rest is overlap
+	// with chunk i+1, indexed only so that boundary-straddling matches are seen
+	owned []int
+}
+
+// NewChunkedModel reads the file at path in chunkSize-byte pieces and builds one
+// suffix array per piece. Only one chunk (plus overlap) is read into memory at a time
+// while building, though every built index is kept. Results match a single index for
+// queries of up to chunkOverlap bytes. An empty file yields ErrEmptyCorpus.
+func NewChunkedModel(path string, chunkSize int) (*ChunkedModel, error) {
+	if chunkSize <= 0 {
+		return nil, errors.New("chunk size must be positive")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	m := &ChunkedModel{}
+	// buf holds the current chunk followed by the overlap read ahead from the next one
+	buf := make([]byte, 0, chunkSize+chunkOverlap)
+	for {
+		n, err := io.ReadFull(r, buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		eof := err != nil
+		if len(buf) == 0 {
+			break
+		}
+		owned := min(chunkSize, len(buf))
+		if eof {
+			owned = len(buf)
+		}
+		data := make([]byte, len(buf))
+		copy(data, buf)
+		m.chunks = append(m.chunks, suffixarray.New(data))
+		m.owned = append(m.owned, owned)
+
+		// Carry the overlap forward as the start of the next chunk
+		buf = buf[:copy(buf, buf[owned:])]
+		if eof {
+			break
+		}
+	}
+	if len(m.chunks) == 0 {
+		return nil, fmt.Errorf("%s: %w", path, ErrEmptyCorpus)
+	}
+	return m, nil
+}
+
+// Len returns the total corpus size in bytes.
+func (m *ChunkedModel) Len() int {
+	var n int
+	for _, owned := range m.owned {
+		n += owned
+	}
+	return n
+}
+
+// Count returns how many times query occurs in the corpus.
+func (m *ChunkedModel) Count(query []byte) int {
+	var count int
+	for i, idx := range m.chunks {
+		for _, off := range idx.Lookup(query, -1) {
+			if off < m.owned[i] {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// Continuations counts the bytes that immediately follow each occurrence of query.
+func (m *ChunkedModel) Continuations(query []byte) map[byte]int {
+	counts := make(map[byte]int)
+	for i, idx := range m.chunks {
+		data := idx.Bytes()
+		for _, off := range idx.Lookup(query, -1) {
+			if pos := off + len(query); off < m.owned[i] && pos < len(data) {
+				counts[data[pos]]++
+			}
+		}
+	}
+	return counts
+}
+
+// Distribution is BuildDistribution over the chunked corpus: it returns the
+// unnormalized combined next-byte distribution for context plus per-level n values
+// and match counts, using k levels (k<=0 for all; there is no auto mode here).
+func (m *ChunkedModel) Distribution(context string, k int) (map[byte]float64, []int, []int) {
+	var levels []level
+	lastNumMatches := 0
+	for i := 0; i < len(context) && (k <= 0 || len(levels) < k); i++ {
+		counts := make(map[byte]float64)
+		numMatches := 0
+		for ch, c := range m.Continuations([]byte(context[i:])) {
+			counts[ch] = float64(c)
+			numMatches += c
+		}
+		if numMatches > lastNumMatches {
+			levels = append(levels, level{counts, numMatches, len(context) - i})
+			lastNumMatches = numMatches
+		}
+	}
+	return combineLevels(levels, nil)
+}
@@ -0,0 +1,66 @@
+package infinigram
+
+import (
+	"errors"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestChunkedModelMatchesSingleIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "corpus.txt")
+	if err := os.WriteFile(path, []byte(testCorpus), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	idx := newTestIndex(t, testCorpus)
+	// Small chunks put many matches across chunk boundaries
+	m, err := NewChunkedModel(path, 17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != len(testCorpus) {
+		t.Errorf("Len = %d, want %d", m.Len(), len(testCorpus))
+	}
+
+	for i := range testCorpus {
+		for n := 1; n <= 8 && i+n <= len(testCorpus); n++ {
+			query := testCorpus[i : i+n]
+			if got, want := m.Count([]byte(query)), Count(idx, query); got != want {
+				t.Errorf("Count(%q) = %d, want %d", query, got, want)
+			}
+			want := make(map[byte]int)
+			for _, off := range idx.Lookup([]byte(query), -1) {
+				if off+n < len(testCorpus) {
+					want[testCorpus[off+n]]++
+				}
+			}
+			if got := m.Continuations([]byte(query)); !maps.Equal(got, want) {
+				t.Errorf("Continuations(%q) = %v, want %v", query, got, want)
+			}
+		}
+	}
+
+	for _, context := range []string{"the cat ", "a dog sat on ", "ran from the "} {
+		got, gotNs, gotMatches := m.Distribution(context, 3)
+		want, wantNs, wantMatches := BuildDistribution(idx, context, 3, nil)
+		if !slices.Equal(gotNs, wantNs) || !slices.Equal(gotMatches, wantMatches) {
+			t.Errorf("%q: levels %v %v, want %v %v", context, gotNs, gotMatches, wantNs, wantMatches)
+		}
+		if !maps.EqualFunc(got, want, func(a, b float64) bool { return math.Abs(a-b) <= 1e-9*b }) {
+			t.Errorf("%q: distribution %v, want %v", context, got, want)
+		}
+	}
+}
+
+func TestChunkedModelEmptyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.txt")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewChunkedModel(path, 16); !errors.Is(err, ErrEmptyCorpus) {
+		t.Errorf("err = %v, want ErrEmptyCorpus", err)
+	}
+}
@@ -0,0 +1,336 @@
+// Command infini-gram generates text from a corpus (data.txt by default) with an
+// infini-gram model and reports statistics about the generation. Flags set the prompt,
+// length, temperature and levels, or select other modes, such as corpus statistics
+// (-stats) or string lookups (-query).
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"index/suffixarray"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"math/rand"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	infinigram "github.com/nathan-barry/tiny-infini-gram"
+)
+
+func measurePerplexity(idx *suffixarray.Index, trainData, valData []byte, k int) {
+	// Compute perplexity on validation set with k=-1 (all levels)
+	fmt.Printf("\nComputing perplexity on %d val chars...\n", len(valData))
+	start := time.Now()
+	ppl := infinigram.Perplexity(idx, string(valData), k, 100)
+	fmt.Printf("Validation Perplexity (k=%d): %.2f (took %.2fs)\n", k, ppl, time.Since(start).Seconds())
+
+	// Compute perplexity on train set with k=-1 (all levels)
+	fmt.Printf("\nComputing perplexity on %d train chars...\n", len(trainData))
+	start = time.Now()
+	ppl = infinigram.Perplexity(idx, string(trainData), k, 100)
+	fmt.Printf("Train Perplexity (k=%d): %.2f (took %.2fs)\n", k, ppl, time.Since(start).Seconds())
+}
+
+// loadOrBuildIndex returns the index saved at path if there is one and it was built
+// from corpus, and otherwise indexes corpus, saving the result to path if it is set.
+// An index of some other corpus, such as one saved before -data or -limit changed, is
+// rebuilt rather than silently used.
+func loadOrBuildIndex(path string, corpus []byte) (*suffixarray.Index, error) {
+	if path != "" {
+		idx, err := infinigram.LoadIndex(path)
+		switch {
+		case err == nil && infinigram.CorpusHash(idx.Bytes()) == infinigram.CorpusHash(corpus):
+			return idx, nil
+		case err == nil:
+			fmt.Fprintf(os.Stderr, "%s indexes a different corpus; rebuilding it\n", path)
+		case !errors.Is(err, fs.ErrNotExist):
+			return nil, err
+		}
+	}
+	idx := suffixarray.New(corpus)
+	if path != "" {
+		if err := infinigram.SaveIndex(idx, path); err != nil {
+			return nil, err
+		}
+	}
+	return idx, nil
+}
+
+// writeHeapProfile writes a heap profile to path, reporting failures on stderr.
+func writeHeapProfile(path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer f.Close()
+	runtime.GC() // get up-to-date statistics
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// seedEnv names the environment variable consulted for a seed when -seed is not given.
+const seedEnv = "TINYINFINI_SEED"
+
+// resolveSeed picks the RNG seed with precedence flag > environment > time: the -seed
+// flag value if it was set, else the TINYINFINI_SEED value if non-empty, else the
+// current time.
+func resolveSeed(flagSet bool, flagSeed int64, env string) (int64, error) {
+	if flagSet {
+		return flagSeed, nil
+	}
+	if env != "" {
+		seed, err := strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s %q: %w", seedEnv, env, err)
+		}
+		return seed, nil
+	}
+	return time.Now().UnixNano(), nil
+}
+
+// writeCorpusStats prints s for the -stats flag, either as a readable report or as
+// indented JSON.
+func writeCorpusStats(w io.Writer, s infinigram.CorpusSummary, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Corpus SHA-256:   %s\n", s.Hash)
+	fmt.Fprintf(&b, "Corpus size:      %d bytes\n", s.Size)
+	fmt.Fprintf(&b, "Distinct bytes:   %d\n", s.DistinctBytes)
+	fmt.Fprintf(&b, "Longest repeat:   %d bytes, %d occurrences\n", s.LongestRepeat, s.RepeatCount)
+	fmt.Fprintln(&b, "Most frequent bytes:")
+	for _, nc := range s.TopBytes {
+		fmt.Fprintf(&b, "  %-6q %8d  %5.2f%%\n", nc.Ngram, nc.Count, 100*float64(nc.Count)/float64(s.Size))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeQuery prints q for the -query flag, either as a readable report or as
+// indented JSON.
+func writeQuery(w io.Writer, q infinigram.QueryResult, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(q)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Query:            %q\n", q.Query)
+	fmt.Fprintf(&b, "Occurrences:      %d\n", q.Count)
+	fmt.Fprintf(&b, "Longest suffix:   %d of %d bytes\n", q.LongestSuffix, len(q.Query))
+	if len(q.Continuations) > 0 {
+		fmt.Fprintln(&b, "Top continuations:")
+	}
+	for _, c := range q.Continuations {
+		fmt.Fprintf(&b, "  %-6q %8d  %6.2f%%\n", c.Next, c.Count, 100*c.Probability)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if errors.As(err, new(usageError)) {
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+// usageError is a bad flag value. It exits with status 2, as flag's own errors do.
+type usageError struct{ error }
+
+func (e usageError) Unwrap() error { return e.error }
+
+// run is the whole command. It returns errors instead of exiting so that deferred
+// work, such as flushing profiles, always runs.
+func run() error {
+	dataPath := flag.String("data", "data.txt", "training corpus; the first 90% is indexed")
+	prompt := flag.String("prompt", "First Citizen:", "text to continue")
+	maxChars := flag.Int("max", 1000, "length of the output in bytes, prompt included")
+	temp := flag.Float64("temp", 0.8, "sampling temperature (0 for greedy)")
+	kFlag := flag.Int("k", 3, "number of n-gram levels to mix (-1 for all, 0 for auto)")
+	mode := flag.String("mode", "klevel", "sampler: klevel (mix -k levels), all (mix every matching level) or infinigram (longest level with -min-count matches only)")
+	minCount := flag.Int("min-count", 1, "with -mode infinigram, the fewest continuations a level needs to be used")
+	seedFlag := flag.Int64("seed", 0, "random seed (default: $"+seedEnv+", then time-based)")
+	selfPPL := flag.Bool("selfppl", false, "report the perplexity of the generated text under the same model")
+	cpuProfile := flag.String("cpuprofile", "", "write a CPU profile to this file")
+	memProfile := flag.String("memprofile", "", "write a heap profile to this file on exit")
+	dumpLevels := flag.String("dump-levels", "", "print every matching suffix level of this context and exit")
+	corpusStats := flag.Bool("stats", false, "print corpus statistics instead of generating")
+	asJSON := flag.Bool("json", false, "with -stats or -query, print the result as JSON")
+	limit := flag.Int("limit", 0, "index at most this many bytes of the training data (0 for all)")
+	limitRandom := flag.Bool("limit-random", false, "with -limit, index a randomly placed window instead of the start")
+	query := flag.String("query", "", "print the count and top continuations of this string instead of generating")
+	logJSON := flag.Bool("log", false, "log each generation's parameters and results as JSON to stderr")
+	novelty := flag.Int("novelty", 0, "report the fraction of generated n-grams of this length not in the corpus")
+	topK := flag.Int("topk", 0, "sample only from this many most likely next bytes (0 for all)")
+	topP := flag.Float64("topp", 1, "sample only from the most likely next bytes covering this much probability")
+	decay := flag.Float64("decay", 0.1, "weight ratio between consecutive n-gram levels")
+	indexPath := flag.String("index", "", "load the index from this file if it exists and matches the corpus, otherwise build it and save it there")
+	flag.Parse()
+
+	seedSet := false
+	flag.Visit(func(f *flag.Flag) { seedSet = seedSet || f.Name == "seed" })
+	seed, err := resolveSeed(seedSet, *seedFlag, os.Getenv(seedEnv))
+	if err != nil {
+		return usageError{err}
+	}
+	cfg := &infinigram.Config{Rand: rand.New(rand.NewSource(seed)), TopK: *topK, TopP: *topP, Decay: *decay, LookupCacheSize: 4096}
+	if *logJSON {
+		cfg.Logger = slog.New(slog.NewJSONHandler(os.Stderr, nil)).With("seed", seed)
+	}
+
+	// Deferred so profiles are flushed even if generation panics
+	if *cpuProfile != "" {
+		f, err := os.Create(*cpuProfile)
+		if err != nil {
+			return err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return err
+		}
+		defer func() {
+			pprof.StopCPUProfile()
+			f.Close()
+		}()
+	}
+	if *memProfile != "" {
+		defer writeHeapProfile(*memProfile)
+	}
+
+	if math.IsNaN(*temp) {
+		return usageError{fmt.Errorf("-temp: %w", infinigram.ErrInvalidTemperature)}
+	}
+	k := *kFlag
+	switch *mode {
+	case "klevel":
+	case "all":
+		k = -1
+	case "infinigram":
+		k = 1
+		cfg.MinMatches = *minCount
+	default:
+		return usageError{fmt.Errorf("unknown -mode %q", *mode)}
+	}
+
+	data, err := os.ReadFile(*dataPath)
+	if err != nil {
+		return err
+	}
+
+	n := int(float64(len(data)) * 0.9)
+	trainData := data[:n]
+	// valData := data[n:]
+	if len(trainData) == 0 {
+		return fmt.Errorf("%s: %w", *dataPath, infinigram.ErrEmptyCorpus)
+	}
+
+	var limitRand *rand.Rand
+	if *limitRandom {
+		limitRand = rand.New(rand.NewSource(seed))
+	}
+	idx, err := loadOrBuildIndex(*indexPath, infinigram.LimitCorpus(trainData, *limit, limitRand))
+	if err != nil {
+		return err
+	}
+
+	if *dumpLevels != "" {
+		levels := infinigram.DumpLevels(idx, *dumpLevels)
+		if len(levels) == 0 {
+			return fmt.Errorf("-dump-levels %q: %w", *dumpLevels, infinigram.ErrNoMatch)
+		}
+		fmt.Printf("%6s %10s %8s %9s\n", "n", "matches", "top", "topCount")
+		for _, d := range levels {
+			fmt.Printf("%6d %10d %8q %9d\n", d.N, d.NumMatches, d.TopByte, d.TopCount)
+		}
+		return nil
+	}
+
+	if *query != "" {
+		return writeQuery(os.Stdout, infinigram.Query(idx, *query, 10), *asJSON)
+	}
+	if *corpusStats {
+		return writeCorpusStats(os.Stdout, infinigram.CorpusStats(idx), *asJSON)
+	}
+
+	start := time.Now()
+	output, stats := infinigram.GenerateWithConfig(idx, *prompt, *maxChars, *temp, k, cfg)
+	fmt.Println(output)
+	fmt.Printf("\nGenerated %d chars in %.4fs (seed %d, corpus %.12s)\n", len(output), time.Since(start).Seconds(), seed, infinigram.CorpusHash(idx.Bytes()))
+	for i, s := range stats {
+		if s.NMean > 0 {
+			fmt.Printf("  Level %d: n(med=%.1f, avg=%.2f, std=%.2f, p10=%d, p90=%d) m(med=%.1f, avg=%.1f, std=%.1f)\n",
+				i+1, s.NMedian, s.NMean, s.NStd, s.NP10, s.NP90, s.MatchMedian, s.MatchMean, s.MatchStd)
+		}
+	}
+	if *selfPPL {
+		// Very low values flag memorized or looping output
+		fmt.Printf("\nSelf-perplexity (k=%d): %.2f\n", k, infinigram.Perplexity(idx, output, k, 100))
+	}
+	if *novelty > 0 {
+		fmt.Printf("\nNovelty (n=%d): %.1f%% of n-grams not in the corpus\n", *novelty, 100*infinigram.NoveltyRate(idx, output, *novelty))
+	}
+
+	// Histogram of n-gram lengths used across all levels
+	var nHist []int
+	for _, s := range stats {
+		for n, c := range s.NHist {
+			for len(nHist) <= n {
+				nHist = append(nHist, 0)
+			}
+			nHist[n] += c
+		}
+	}
+	fmt.Println("\nn-gram length distribution:")
+	fmt.Print(renderHistogram(nHist, 40))
+
+	// measurePerplexity(idx, trainData, valData, k)
+	return nil
+}
+
+// renderHistogram draws hist as aligned ASCII bars, one row per value from the first
+// to the last non-zero bucket. The longest bar is width characters wide.
+func renderHistogram(hist []int, width int) string {
+	lo, hi, peak := -1, -1, 0
+	for v, c := range hist {
+		if c == 0 {
+			continue
+		}
+		if lo < 0 {
+			lo = v
+		}
+		hi = v
+		peak = max(peak, c)
+	}
+	if lo < 0 {
+		return ""
+	}
+
+	labelWidth := len(fmt.Sprint(hi))
+	countWidth := len(fmt.Sprint(peak))
+	var sb strings.Builder
+	for v := lo; v <= hi; v++ {
+		bar := hist[v] * width / peak
+		if hist[v] > 0 && bar == 0 {
+			bar = 1
+		}
+		fmt.Fprintf(&sb, "  n=%*d | %-*s %*d\n", labelWidth, v, width, strings.Repeat("#", bar), countWidth, hist[v])
+	}
+	return sb.String()
+}
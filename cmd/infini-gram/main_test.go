@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"index/suffixarray"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	infinigram "github.com/nathan-barry/tiny-infini-gram"
+)
+
+func TestLoadOrBuildIndexRebuildsForNewCorpus(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "corpus.idx")
+	if _, err := loadOrBuildIndex(path, []byte("first corpus")); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := loadOrBuildIndex(path, []byte("second corpus"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(idx.Bytes()); got != "second corpus" {
+		t.Errorf("index holds %q, want the new corpus", got)
+	}
+
+	// The rebuilt index replaced the stale one on disk
+	idx, err = loadOrBuildIndex(path, []byte("second corpus"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(idx.Bytes()); got != "second corpus" {
+		t.Errorf("reloaded index holds %q, want the new corpus", got)
+	}
+}
+
+func TestRenderHistogram(t *testing.T) {
+	got := renderHistogram([]int{0, 0, 4, 2, 0, 1}, 8)
+	want := "" +
+		"  n=2 | ######## 4\n" +
+		"  n=3 | ####     2\n" +
+		"  n=4 |          0\n" +
+		"  n=5 | ##       1\n"
+	if got != want {
+		t.Errorf("renderHistogram =\n%s\nwant\n%s", got, want)
+	}
+
+	// A non-zero count always gets a visible bar, and labels are right-aligned
+	got = renderHistogram([]int{0, 0, 0, 0, 0, 0, 0, 0, 0, 200, 1}, 10)
+	want = "" +
+		"  n= 9 | ########## 200\n" +
+		"  n=10 | #            1\n"
+	if got != want {
+		t.Errorf("renderHistogram =\n%s\nwant\n%s", got, want)
+	}
+
+	if got := renderHistogram([]int{0, 0}, 10); got != "" {
+		t.Errorf("renderHistogram of an empty histogram = %q, want nothing", got)
+	}
+}
+
+func TestResolveSeed(t *testing.T) {
+	// The flag wins over the environment
+	if seed, err := resolveSeed(true, 7, "42"); err != nil || seed != 7 {
+		t.Errorf("flag and env: got %d, %v; want 7", seed, err)
+	}
+	// An explicit -seed 0 is still a flag value
+	if seed, err := resolveSeed(true, 0, "42"); err != nil || seed != 0 {
+		t.Errorf("flag 0 and env: got %d, %v; want 0", seed, err)
+	}
+	if seed, err := resolveSeed(false, 7, "42"); err != nil || seed != 42 {
+		t.Errorf("env only: got %d, %v; want 42", seed, err)
+	}
+	if _, err := resolveSeed(false, 0, "forty-two"); err == nil {
+		t.Error("invalid env value: no error")
+	}
+
+	before := time.Now().UnixNano()
+	seed, err := resolveSeed(false, 7, "")
+	if err != nil || seed < before || seed > time.Now().UnixNano() {
+		t.Errorf("neither: got %d, %v; want the current time", seed, err)
+	}
+}
+
+// runCommand runs the command with args in place of the command line and returns
+// what it printed to stdout.
+func runCommand(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	defer func(args []string, fs *flag.FlagSet, stdout *os.File) {
+		os.Args, flag.CommandLine, os.Stdout = args, fs, stdout
+	}(os.Args, flag.CommandLine, os.Stdout)
+
+	out, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	os.Args = append([]string{"infini-gram"}, args...)
+	flag.CommandLine = flag.NewFlagSet("infini-gram", flag.ContinueOnError)
+	os.Stdout = out
+	runErr := run()
+
+	printed, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(printed), runErr
+}
+
+// writeCorpus writes a small corpus to a temporary file and returns its path.
+func writeCorpus(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "data.txt")
+	corpus := strings.Repeat("the cat sat on the mat. the dog sat on the log. ", 20)
+	if err := os.WriteFile(path, []byte(corpus), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSelfPerplexity(t *testing.T) {
+	data := writeCorpus(t)
+	out, err := runCommand(t, "-data", data, "-prompt", "the ", "-max", "60", "-seed", "1", "-selfppl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ppl float64
+	i := strings.Index(out, "Self-perplexity (k=3): ")
+	if i < 0 {
+		t.Fatalf("no self-perplexity in output:\n%s", out)
+	}
+	if _, err := fmt.Sscan(out[i+len("Self-perplexity (k=3): "):], &ppl); err != nil || ppl < 1 {
+		t.Errorf("self-perplexity %v, %v; want a value >= 1", ppl, err)
+	}
+
+	out, err = runCommand(t, "-data", data, "-prompt", "the ", "-max", "60", "-seed", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "Self-perplexity") {
+		t.Errorf("self-perplexity reported without -selfppl:\n%s", out)
+	}
+}
+
+func TestWriteCorpusStats(t *testing.T) {
+	s := infinigram.CorpusSummary{
+		Hash:          "abc123",
+		Size:          200,
+		DistinctBytes: 3,
+		TopBytes:      []infinigram.NgramCount{{Ngram: "a", Count: 150}, {Ngram: "\n", Count: 50}},
+		LongestRepeat: 12,
+		RepeatCount:   4,
+	}
+	var buf bytes.Buffer
+	if err := writeCorpusStats(&buf, s, false); err != nil {
+		t.Fatal(err)
+	}
+	want := "" +
+		"Corpus SHA-256:   abc123\n" +
+		"Corpus size:      200 bytes\n" +
+		"Distinct bytes:   3\n" +
+		"Longest repeat:   12 bytes, 4 occurrences\n" +
+		"Most frequent bytes:\n" +
+		"  \"a\"         150  75.00%\n" +
+		"  \"\\n\"         50  25.00%\n"
+	if buf.String() != want {
+		t.Errorf("report =\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := writeCorpusStats(&buf, s, true); err != nil {
+		t.Fatal(err)
+	}
+	var decoded infinigram.CorpusSummary
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || !reflect.DeepEqual(decoded, s) {
+		t.Errorf("JSON %s decodes to %+v, %v; want %+v", buf.String(), decoded, err, s)
+	}
+}
+
+func TestStatsCommand(t *testing.T) {
+	data := writeCorpus(t)
+	out, err := runCommand(t, "-data", data, "-stats", "-json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got infinigram.CorpusSummary
+	if err := json.Unmarshal([]byte(out), &got); err != nil {
+		t.Fatalf("output isn't JSON: %v\n%s", err, out)
+	}
+	// Statistics describe the indexed training data, the first 90% of the file
+	corpus, err := os.ReadFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := infinigram.CorpusStats(suffixarray.New(corpus[:len(corpus)*9/10]))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("-stats printed %+v, want %+v", got, want)
+	}
+}
+
+func TestLimitFlag(t *testing.T) {
+	data := writeCorpus(t)
+	for _, args := range [][]string{{"-limit", "100"}, {"-limit", "100", "-limit-random", "-seed", "3"}} {
+		out, err := runCommand(t, append([]string{"-data", data, "-stats", "-json"}, args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s infinigram.CorpusSummary
+		if err := json.Unmarshal([]byte(out), &s); err != nil || s.Size != 100 {
+			t.Errorf("%v: indexed %d bytes (%v), want 100", args, s.Size, err)
+		}
+	}
+}
+
+func TestWriteQuery(t *testing.T) {
+	q := infinigram.QueryResult{Query: "ab", Count: 4, LongestSuffix: 2, Continuations: []infinigram.Continuation{
+		{Next: "c", Count: 2, Probability: 2.0 / 3},
+		{Next: "\n", Count: 1, Probability: 1.0 / 3},
+	}}
+	var buf bytes.Buffer
+	if err := writeQuery(&buf, q, false); err != nil {
+		t.Fatal(err)
+	}
+	want := "" +
+		"Query:            \"ab\"\n" +
+		"Occurrences:      4\n" +
+		"Longest suffix:   2 of 2 bytes\n" +
+		"Top continuations:\n" +
+		"  \"c\"           2   66.67%\n" +
+		"  \"\\n\"          1   33.33%\n"
+	if buf.String() != want {
+		t.Errorf("report =\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := writeQuery(&buf, q, true); err != nil {
+		t.Fatal(err)
+	}
+	var decoded infinigram.QueryResult
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || !reflect.DeepEqual(decoded, q) {
+		t.Errorf("JSON %s decodes to %+v, %v; want %+v", buf.String(), decoded, err, q)
+	}
+}
+
+func TestQueryCommand(t *testing.T) {
+	data := writeCorpus(t)
+	out, err := runCommand(t, "-data", data, "-query", "sat on the ", "-json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got infinigram.QueryResult
+	// Nothing but the JSON is printed, so no text was generated
+	if err := json.Unmarshal([]byte(out), &got); err != nil {
+		t.Fatalf("output isn't JSON: %v\n%s", err, out)
+	}
+	if got.Count == 0 || got.LongestSuffix != len("sat on the ") || len(got.Continuations) != 2 {
+		t.Errorf("-query printed %+v, want matches continuing with m and l", got)
+	}
+}
+
+func TestInfinigramMode(t *testing.T) {
+	data := writeCorpus(t)
+	// No suffix has 10000 continuations in a 1 KB corpus, so nothing is generated
+	out, err := runCommand(t, "-data", data, "-prompt", "the ", "-max", "60", "-seed", "1", "-mode", "infinigram", "-min-count", "10000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "the \n") {
+		t.Errorf("-min-count 10000 generated:\n%s", out)
+	}
+	out, err = runCommand(t, "-data", data, "-prompt", "the ", "-max", "60", "-seed", "1", "-mode", "infinigram", "-min-count", "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "Generated 60 chars") {
+		t.Errorf("-min-count 3 didn't generate 60 chars:\n%s", out)
+	}
+}
+
+func TestCommandErrors(t *testing.T) {
+	data := writeCorpus(t)
+	_, err := runCommand(t, "-data", data, "-temp", "NaN")
+	var usage usageError
+	if !errors.Is(err, infinigram.ErrInvalidTemperature) || !errors.As(err, &usage) {
+		t.Errorf("-temp NaN: %v, want a usage error wrapping ErrInvalidTemperature", err)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.txt")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runCommand(t, "-data", empty); !errors.Is(err, infinigram.ErrEmptyCorpus) {
+		t.Errorf("empty corpus: %v, want ErrEmptyCorpus", err)
+	}
+
+	if _, err := runCommand(t, "-data", data, "-dump-levels", "zq"); !errors.Is(err, infinigram.ErrNoMatch) {
+		t.Errorf("-dump-levels zq: %v, want ErrNoMatch", err)
+	}
+	if out, err := runCommand(t, "-data", data, "-dump-levels", "the "); err != nil || !strings.Contains(out, "topCount") {
+		t.Errorf("-dump-levels \"the \": %v\n%s", err, out)
+	}
+}
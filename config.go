@@ -0,0 +1,684 @@
+package infinigram
+
+import (
+	"bufio"
+	"fmt"
+	"index/suffixarray"
+	"log/slog"
+	"math"
+	"math/rand"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Config holds optional settings for sampling, generation, and scoring. The zero value
+// gives the default behavior.
+type Config struct {
+	// Strict makes Generate always produce maxChars bytes. When no suffix of the context
+	// matches, the next byte is drawn from the corpus unigram distribution instead of
+	// ending generation early.
+	Strict bool
+
+	// Rand is the source of randomness for every draw. Nil uses the global math/rand
+	// source. A *rand.Rand is not safe for concurrent use, so give each goroutine its own.
+	Rand *rand.Rand
+
+	// PrimeBias nudges the opening of a generation: each listed byte's log-weight is
+	// shifted by its bias, scaled linearly from full strength at the first generated
+	// byte down to zero after PrimeDecaySteps bytes. It only reweights bytes that
+	// already have a continuation, so it never forces an unseen byte.
+	PrimeBias       map[byte]float64
+	PrimeDecaySteps int
+
+	// OutputCounts, if non-nil, is incremented by Generate for every byte it emits
+	// (the prompt is not counted), so its values sum to the number of generated bytes.
+	// Use a separate map per concurrent generation.
+	OutputCounts map[byte]int
+
+	// StartN caps the longest suffix of the context that is looked up: backoff starts
+	// from a suffix of length StartN instead of the whole context. This skips long
+	// lookups that rarely match on big contexts, at the cost of never using a match
+	// longer than StartN. Zero starts from the full context.
+	StartN int
+
+	// LeaveOneOut is for scoring text that is itself part of the corpus. The scored text
+	// is taken to start at corpus offset TextOffset, and when scoring text[i] the match
+	// whose continuation is corpus position TextOffset+i is ignored, so a position can't
+	// trivially predict itself.
+	LeaveOneOut bool
+	TextOffset  int
+
+	// Debug checks the distribution before every draw and panics with a descriptive
+	// message if any weight is NaN, infinite, or negative, or if the weights don't sum
+	// to a positive finite value. A distribution with no candidates is not an error;
+	// it ends the run as it would without Debug. It is meant for tests and debugging.
+	Debug bool
+
+	// AddK smooths scoring distributions: AddK/V probability mass is added to each of the
+	// V distinct bytes that occur in the corpus before renormalizing, and positions with
+	// no match get a uniform distribution over those bytes. Bytes absent from the corpus
+	// still get the Epsilon floor. With AddKAllBytes the mass is spread over all 256
+	// byte values instead, so no byte is ever floored. Zero disables smoothing.
+	AddK         float64
+	AddKAllBytes bool
+
+	// Epsilon is the probability scoring charges a character the model gives no
+	// probability, including every character whose context has no match. Zero uses
+	// defaultEpsilon, 1e-10.
+	Epsilon float64
+
+	// RecencyHalfLife favors matches from later in the corpus, for chronologically
+	// ordered data: a continuation at distance d bytes from the end of the corpus counts
+	// 2^(-d/RecencyHalfLife) instead of 1. Zero weights every match equally.
+	RecencyHalfLife float64
+
+	// CorpusAlphabetOnly guarantees Generate only emits bytes that occur somewhere in
+	// the corpus by dropping any other candidate before sampling. Continuations always
+	// come from the corpus, so this is normally a no-op kept as a safety net.
+	CorpusAlphabetOnly bool
+
+	// ValidUTF8 makes Generate treat the corpus as UTF-8 text: the context window
+	// starts on a rune boundary, and only bytes that keep the output a valid UTF-8
+	// prefix are candidates, so each multibyte character is emitted whole. Generation
+	// runs past maxChars by up to 3 bytes to finish a character, and a character left
+	// incomplete by a dead end is dropped, so the generated text is always valid UTF-8
+	// if the prompt is.
+	ValidUTF8 bool
+
+	// CacheSize bounds an LRU cache of next-byte distributions keyed by context, shared
+	// across the positions of one scoring run. It pays off on repetitive text, where the
+	// same context recurs. Zero disables caching; it is also off under LeaveOneOut.
+	CacheSize int
+
+	// SkipUnmatched leaves positions whose context has no match in the corpus out of
+	// perplexity entirely instead of charging them the smoothing floor, giving a
+	// perplexity over covered positions. Use Evaluate to see the coverage.
+	SkipUnmatched bool
+
+	// PhraseMaxChunk enables phrase shortcuts in Generate: when the longest matching
+	// suffix of the context occurs at least PhraseMinFrequency times and every
+	// occurrence is followed by the same bytes, up to PhraseMaxChunk of those bytes
+	// are emitted in one step instead of sampling them one by one (lower levels are
+	// not mixed in for them). Zero or one disables it.
+	PhraseMaxChunk     int
+	PhraseMinFrequency int
+
+	// MaxMatchThreshold drives auto level selection (k=0): levels are added from the
+	// longest match down until one has more than MaxMatchThreshold matches, which marks
+	// it as too generic to help; that level and all shorter ones are left out. The
+	// longest matching level is always used. Zero means no threshold, so k=0 then uses
+	// every level like k=-1.
+	MaxMatchThreshold int
+
+	// ContextWindow is how many trailing bytes of the text generation matches against,
+	// which caps the longest usable n-gram. Zero uses defaultContextWindow; a negative
+	// value uses the whole text. Only the longest suffix that occurs in the corpus is
+	// looked up first, so an unbounded window costs little more than a bounded one.
+	ContextWindow int
+
+	// MinMatches skips any level with fewer than MinMatches continuations, backing off
+	// to shorter, better-supported suffixes; this is the infini-gram paper's confidence
+	// threshold against verbatim copying of passages seen only once or twice. Skipped
+	// levels don't count toward k. If no level qualifies there is no match. Zero or 1
+	// keeps every level.
+	MinMatches int
+
+	// Restarts and RestartInterval make Generate resist repetition loops: it generates
+	// RestartInterval bytes at a time, drawing each segment Restarts times from the
+	// text so far and keeping the candidate with the most distinct 4-grams over the
+	// segment and the text just before it, so a candidate that loops or stops short
+	// loses. Generation costs about Restarts times as much. Restarts below two or a zero interval disable it.
+	Restarts        int
+	RestartInterval int
+
+	// MaxOffsets caps how many continuations are counted per level. When a suffix has
+	// more, a uniform sample of MaxOffsets of them is drawn from Rand by reservoir
+	// sampling and their counts are scaled by total/MaxOffsets, so the distribution is
+	// an unbiased estimate of the full one at a bounded cost. Match counts still report
+	// the full total. Zero counts every continuation.
+	MaxOffsets int
+
+	// SkipPrefix makes scoring treat the first SkipPrefix bytes of the text as context
+	// only: they condition later positions but are not scored themselves. This gives a
+	// continuation perplexity when the text starts with a prompt.
+	SkipPrefix int
+
+	// Circular treats the corpus as wrapping around: a match that ends at the very end
+	// of the corpus is continued by the corpus's first byte instead of being dropped.
+	// Without it those matches count toward nothing, which skews small corpora.
+	Circular bool
+
+	// EOS marks EOSByte as a document boundary in a corpus of concatenated documents
+	// (see NewIndexFromReaders). Contexts are cut just before their last EOSByte, so
+	// matches never reach back into the previous document and the byte after a
+	// boundary is predicted from how documents start. Scoring therefore charges a
+	// document's first byte a normal probability, and EOSByte itself is scored as the
+	// prediction that a document ends. With StopAtEOS, Generate stops when it draws
+	// EOSByte instead of starting a new document, leaving it out of the result.
+	EOS       bool
+	EOSByte   byte
+	StopAtEOS bool
+
+	// Workers is how many goroutines scoring may use: PerplexityWithConfig and the other
+	// scoring functions split a long text into chunks of positions, and
+	// EvaluateManyWithConfig scores several texts at once. Zero or one scores
+	// sequentially. So does any MaxOffsets, since its subsampling draws from Rand,
+	// which can't be shared between goroutines.
+	Workers int
+
+	// IDFWeighting makes Generate scale each candidate's weight by log(N/freq), where
+	// freq is how often the byte occurs in the N-byte corpus. Ubiquitous bytes such as
+	// spaces are downweighted in favor of more distinctive ones. The table is computed
+	// once per generation.
+	IDFWeighting bool
+
+	// Allowed, if non-empty, restricts the model to these bytes: continuations outside
+	// the set are ignored, so backoff moves to shorter suffixes when the longest match
+	// has no allowed continuation, and Generate draws uniformly from Allowed when no
+	// suffix has one. Scoring sees the same restricted distributions.
+	Allowed []byte
+
+	// Decay is the exponential decay used to mix levels: level i (0 is the longest
+	// match) is weighted by Decay^i, so smaller values trust the longest match more.
+	// Zero or negative uses defaultDecay.
+	Decay float64
+
+	// LevelWeights, if non-empty, replaces the exponential decay used to mix levels:
+	// level i (0 is the longest match) is weighted by LevelWeights[i]. Levels past the
+	// end of the vector get weight zero, or the last weight if ExtendLevelWeights is
+	// set. See LoadLevelWeights.
+	LevelWeights       []float64
+	ExtendLevelWeights bool
+
+	// Interpolation, if it has a lambda for every matched level, mixes levels by
+	// linear interpolation as in a classic back-off LM: level i's next-byte
+	// probabilities (0 is the longest match) are weighted by Interpolation[i], with the
+	// lambdas in use renormalized to sum to 1. Steps with more levels than lambdas,
+	// and a nil Interpolation, use Decay or LevelWeights as usual.
+	Interpolation []float64
+
+	// MaxRunes, if positive, replaces Generate's maxChars byte limit with a limit of
+	// MaxRunes UTF-8 runes of generated text, so multibyte characters count once.
+	// Generation stops only after a rune is complete; an invalid byte counts as one
+	// rune, as in utf8.RuneCount. The count is exact with ValidUTF8. Without it, a byte
+	// that cuts a multibyte sequence short completes several runes at once, so the
+	// output can overshoot by up to 3. It is ignored when Restarts is in effect.
+	MaxRunes int
+
+	// MaxLines, if positive, stops Generate right after it emits the MaxLines-th
+	// newline; newlines in the prompt don't count. maxChars still caps the length. It
+	// is ignored when Restarts is in effect.
+	MaxLines int
+
+	// StopSequences stops Generate as soon as the text ends with any of them. Only a
+	// match ending in generated text counts, so a prompt that ends with a stop sequence
+	// doesn't stop generation at once, though a match may start inside the prompt. With
+	// TrimStop the matched sequence is removed from the result, except for any part of
+	// it that belongs to the prompt, and GenerateStream, GenerateTokens and the other
+	// per-byte callbacks never see it: bytes that could begin a stop sequence are held
+	// back until they can't, or are trimmed. It is ignored when Restarts is in effect.
+	StopSequences []string
+	TrimStop      bool
+
+	// Alpha adds alpha to the count of every byte observed at any level, at every
+	// level, before the levels are mixed. A byte the longest match never continued with
+	// then keeps some probability if a shorter level saw it, which makes low-temperature
+	// sampling explore a little instead of looping. Zero disables it. It applies to
+	// scoring too.
+	Alpha float64
+
+	// DropShortLevelsThreshold keeps confident long matches from being diluted: when
+	// the longest matching suffix has at least this many bytes, every level shorter
+	// than the threshold is left out of the mix. Zero disables it.
+	DropShortLevelsThreshold int
+
+	// MinProbFloor lifts the tail before each draw: after temperature, every candidate
+	// gets probability at least MinProbFloor by mixing the distribution with a uniform
+	// one over the candidates, p' = floor + (1 - n*floor)*p for n candidates, which
+	// still sums to 1. A floor of 1/n or more makes the draw uniform. It never adds
+	// candidates. Zero disables it.
+	MinProbFloor float64
+
+	// MinAcceptableN makes Generate refuse to sample from short contexts: when the
+	// longest matching suffix is shorter than MinAcceptableN bytes, the step is treated
+	// as having no match, so generation stops, or under Strict falls back to the
+	// unigram distribution. Zero accepts any match.
+	MinAcceptableN int
+
+	// DedupeWindow keeps duplicated corpus regions from being counted twice: when
+	// collecting a level's continuations, matches preceded by the same DedupeWindow
+	// bytes and followed by the same byte count once. Match counts are deduplicated
+	// too. Zero counts every match.
+	DedupeWindow int
+
+	// Logger, if non-nil, receives an Info record for every Generate call with its
+	// parameters (prompt, temp, k, context length), the corpus hash, the elapsed time
+	// and summary stats. Attach run-level attributes such as the seed with
+	// Logger.With. Nil logs nothing.
+	Logger *slog.Logger
+
+	// Antithetic makes GenerateBatch draw its samples in antithetic pairs: the second
+	// sample of each pair reuses the first one's uniform draws u as 1-u. Paired samples
+	// are negatively correlated, which lowers the variance of metrics averaged over
+	// the batch for the same number of samples.
+	Antithetic bool
+
+	// TopK keeps only the TopK highest-weighted candidates at each draw, before
+	// temperature, so high temperatures can't surface very rare bytes. Ties at the
+	// cut are broken by byte value. Zero or negative keeps every candidate. (This is
+	// unrelated to the k argument, which counts n-gram levels.)
+	TopK int
+
+	// TopP keeps only the smallest set of most likely candidates whose combined
+	// probability, before temperature, reaches TopP (nucleus sampling). It is applied
+	// after TopK, and at least one candidate is always kept. Zero, negative, or 1 and
+	// above keeps every candidate.
+	TopP float64
+
+	// RepetitionPenalty divides the weight of every candidate byte that occurs among
+	// the last RepetitionWindow bytes of the text (prompt included) before sampling,
+	// discouraging loops. Penalized bytes keep a positive weight, so a step whose only
+	// candidates were all seen recently still emits one of them. 1 or less disables it.
+	RepetitionPenalty float64
+	// RepetitionWindow is how many trailing bytes RepetitionPenalty looks at; zero or
+	// negative uses defaultRepetitionWindow.
+	RepetitionWindow int
+
+	// LookupCacheSize, if positive, memoizes suffix array lookups within each Generate
+	// call in an LRU cache of that many query strings. Consecutive steps look up many of
+	// the same short suffixes, which are the most expensive ones since they have the
+	// most occurrences. Each entry holds every occurrence of its query, so memory grows
+	// with the corpus as well as the size.
+	LookupCacheSize int
+
+	// lookups is the per-generation lookup cache enabled by LookupCacheSize
+	lookups *lruCache[[]int]
+
+	// uniform, if set, overrides the source of the uniform draws used for sampling
+	uniform func() float64
+
+	// scratch, if set, is the map generation reuses for each step's distribution, so
+	// a Sampler's generations share its buffer rather than allocating their own
+	scratch map[byte]float64
+}
+
+// truncate applies TopK and TopP to chars, which are in ascending byte order, deletes
+// the dropped candidates from dist, and returns the kept ones in the same order.
+func (c *Config) truncate(chars []byte, dist map[byte]float64) []byte {
+	if c == nil || (c.TopK <= 0 && !(c.TopP > 0 && c.TopP < 1)) {
+		return chars
+	}
+	// Rank from most to least likely; the stable sort breaks ties by byte value
+	ranked := slices.Clone(chars)
+	sort.SliceStable(ranked, func(i, j int) bool { return dist[ranked[i]] > dist[ranked[j]] })
+	keep := len(ranked)
+	if c.TopK > 0 {
+		keep = min(keep, c.TopK)
+	}
+	if c.TopP > 0 && c.TopP < 1 {
+		var total float64
+		for _, ch := range ranked[:keep] {
+			total += dist[ch]
+		}
+		var cum float64
+		for i, ch := range ranked[:keep] {
+			if cum += dist[ch]; cum >= c.TopP*total {
+				keep = i + 1
+				break
+			}
+		}
+	}
+	for _, ch := range ranked[keep:] {
+		delete(dist, ch)
+	}
+	return slices.DeleteFunc(chars, func(ch byte) bool {
+		_, ok := dist[ch]
+		return !ok
+	})
+}
+
+// dedupeWindow returns how many bytes before a match identify its copy, or 0.
+func (c *Config) dedupeWindow() int {
+	if c == nil || c.DedupeWindow < 0 {
+		return 0
+	}
+	return c.DedupeWindow
+}
+
+// applyProbFloor applies MinProbFloor to dist in place, where total is the sum of its
+// weights; the sum is unchanged.
+func (c *Config) applyProbFloor(dist map[byte]float64, total float64) {
+	if c == nil || c.MinProbFloor <= 0 || len(dist) == 0 {
+		return
+	}
+	floor := min(c.MinProbFloor, 1/float64(len(dist)))
+	keep := 1 - float64(len(dist))*floor
+	for ch, w := range dist {
+		dist[ch] = floor*total + keep*w
+	}
+}
+
+// dropShortLevels applies DropShortLevelsThreshold to levels, which run from longest
+// to shortest.
+func (c *Config) dropShortLevels(levels []level) []level {
+	if c == nil || c.DropShortLevelsThreshold <= 0 || len(levels) == 0 || levels[0].n < c.DropShortLevelsThreshold {
+		return levels
+	}
+	for i, lvl := range levels {
+		if lvl.n < c.DropShortLevelsThreshold {
+			return levels[:i]
+		}
+	}
+	return levels
+}
+
+// alpha returns the additive smoothing constant for level counts.
+func (c *Config) alpha() float64 {
+	if c == nil {
+		return 0
+	}
+	return c.Alpha
+}
+
+// defaultDecay is the Decay used when none is set.
+const defaultDecay = 0.1
+
+// levelWeight returns the mixing weight of level i.
+func (c *Config) levelWeight(i int) float64 {
+	if c == nil || len(c.LevelWeights) == 0 {
+		decay := defaultDecay
+		if c != nil && c.Decay > 0 {
+			decay = c.Decay
+		}
+		return math.Pow(decay, float64(i))
+	}
+	if i < len(c.LevelWeights) {
+		return c.LevelWeights[i]
+	}
+	if c.ExtendLevelWeights {
+		return c.LevelWeights[len(c.LevelWeights)-1]
+	}
+	return 0
+}
+
+// levelWeights returns the factor each level's continuation counts are multiplied by
+// when levels are mixed: levelWeight(i), or with Interpolation the normalized lambda
+// over the level's total count.
+func (c *Config) levelWeights(levels []level) []float64 {
+	weights := make([]float64, len(levels))
+	if c == nil || len(c.Interpolation) < len(levels) {
+		for i := range weights {
+			weights[i] = c.levelWeight(i)
+		}
+		return weights
+	}
+	var sum float64
+	for _, lambda := range c.Interpolation[:len(levels)] {
+		sum += lambda
+	}
+	if sum <= 0 {
+		return weights
+	}
+	for i, lvl := range levels {
+		var count float64
+		for _, cnt := range lvl.counts {
+			count += cnt
+		}
+		if count > 0 {
+			weights[i] = c.Interpolation[i] / sum / count
+		}
+	}
+	return weights
+}
+
+// LoadLevelWeights reads a level weight vector for Config.LevelWeights from a file
+// with one number per line, longest level first. Blank lines are skipped.
+func LoadLevelWeights(path string) ([]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var weights []float64
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" {
+			continue
+		}
+		w, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if w < 0 || math.IsNaN(w) || math.IsInf(w, 0) {
+			return nil, fmt.Errorf("%s:%d: level weight must be finite and non-negative, got %v", path, line, w)
+		}
+		weights = append(weights, w)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return weights, nil
+}
+
+// allowedSet returns Allowed as a lookup table, and whether the model is restricted.
+func (c *Config) allowedSet() (set [256]bool, restricted bool) {
+	if c == nil || len(c.Allowed) == 0 {
+		return set, false
+	}
+	for _, b := range c.Allowed {
+		set[b] = true
+	}
+	return set, true
+}
+
+// workers returns how many goroutines scoring may use, at least one. Subsampling
+// draws from Rand, so it always scores with one.
+func (c *Config) workers() int {
+	if c == nil || c.maxOffsets() > 0 {
+		return 1
+	}
+	return max(1, c.Workers)
+}
+
+// circular reports whether a match at the end of the corpus wraps to its start.
+func (c *Config) circular() bool {
+	return c != nil && c.Circular
+}
+
+// skipPrefix returns how many leading bytes of a scored text are context only.
+func (c *Config) skipPrefix() int {
+	if c == nil {
+		return 0
+	}
+	return c.SkipPrefix
+}
+
+// maxOffsets returns the reservoir size for a level, or 0 for no cap.
+func (c *Config) maxOffsets() int {
+	if c == nil || c.MaxOffsets < 0 {
+		return 0
+	}
+	return c.MaxOffsets
+}
+
+// defaultEpsilon is the Epsilon used when none is set.
+const defaultEpsilon = 1e-10
+
+// epsilon returns the smoothing floor for scoring.
+func (c *Config) epsilon() float64 {
+	if c == nil || c.Epsilon <= 0 {
+		return defaultEpsilon
+	}
+	return c.Epsilon
+}
+
+// defaultContextWindow is the ContextWindow used when none is set.
+const defaultContextWindow = 200
+
+// contextWindow returns how many trailing bytes generation looks at, or 0 for all.
+func (c *Config) contextWindow() int {
+	if c == nil || c.ContextWindow == 0 {
+		return defaultContextWindow
+	}
+	return max(c.ContextWindow, 0)
+}
+
+// context returns the part of text that generation matches against.
+func (c *Config) context(text []byte) []byte {
+	if w := c.contextWindow(); w > 0 && len(text) > w {
+		return text[len(text)-w:]
+	}
+	return text
+}
+
+// lookup returns the corpus offsets of every occurrence of query, from the lookup
+// cache if there is one.
+func (c *Config) lookup(idx *suffixarray.Index, query string) []int {
+	if c == nil || c.lookups == nil {
+		return idx.Lookup([]byte(query), -1)
+	}
+	if offsets, ok := c.lookups.get(query); ok {
+		return offsets
+	}
+	offsets := idx.Lookup([]byte(query), -1)
+	c.lookups.put(query, offsets)
+	return offsets
+}
+
+// document returns the part of context from its last EOSByte on, or all of it.
+func (c *Config) document(context string) string {
+	if c == nil || !c.EOS {
+		return context
+	}
+	return context[max(0, strings.LastIndexByte(context, c.EOSByte)):]
+}
+
+// tooRare reports whether a level with numMatches matches is below MinMatches.
+func (c *Config) tooRare(numMatches int) bool {
+	return c != nil && numMatches < c.MinMatches
+}
+
+// tooGeneric reports whether a level with numMatches matches is past MaxMatchThreshold.
+func (c *Config) tooGeneric(numMatches int) bool {
+	return c != nil && c.MaxMatchThreshold > 0 && numMatches > c.MaxMatchThreshold
+}
+
+// phraseRun returns the continuation shared by every occurrence of the longest
+// matching suffix of context, n bytes long, up to PhraseMaxChunk bytes, along with
+// that suffix's occurrence count. It returns a nil run when phrase shortcuts are off
+// or the region isn't deterministic.
+func (c *Config) phraseRun(idx *suffixarray.Index, context string, n int) ([]byte, int) {
+	if c == nil || c.PhraseMaxChunk <= 1 || n == 0 {
+		return nil, 0
+	}
+	offsets := c.lookup(idx, context[len(context)-n:])
+	if len(offsets) < max(c.PhraseMinFrequency, 1) {
+		return nil, 0
+	}
+	data := idx.Bytes()
+	allowed, restricted := c.allowedSet()
+	var run []byte
+	for j := 0; j < c.PhraseMaxChunk; j++ {
+		pos := offsets[0] + n + j
+		if pos >= len(data) {
+			break
+		}
+		ch := data[pos]
+		if restricted && !allowed[ch] {
+			break
+		}
+		for _, off := range offsets[1:] {
+			if p := off + n + j; p >= len(data) || data[p] != ch {
+				return run, len(offsets)
+			}
+		}
+		run = append(run, ch)
+	}
+	return run, len(offsets)
+}
+
+// recencyWeight returns how much a continuation at corpus position pos counts.
+func (c *Config) recencyWeight(pos, corpusLen int) float64 {
+	if c == nil || c.RecencyHalfLife <= 0 {
+		return 1
+	}
+	return math.Exp2(-float64(corpusLen-1-pos) / c.RecencyHalfLife)
+}
+
+// excludedPos returns the corpus position to ignore when scoring text[i], or -1.
+func (c *Config) excludedPos(i int) int {
+	if c == nil || !c.LeaveOneOut {
+		return -1
+	}
+	return c.TextOffset + i
+}
+
+// firstSuffix returns the index into context of the longest suffix to look up.
+func (c *Config) firstSuffix(context string) int {
+	if c == nil || c.StartN <= 0 {
+		return 0
+	}
+	return max(0, len(context)-c.StartN)
+}
+
+// defaultRepetitionWindow is the RepetitionWindow used when none is set.
+const defaultRepetitionWindow = 32
+
+// applyRepetitionPenalty applies RepetitionPenalty to dist in place, given the text
+// generated so far.
+func (c *Config) applyRepetitionPenalty(dist map[byte]float64, text []byte) {
+	if c == nil || !(c.RepetitionPenalty > 1) {
+		return
+	}
+	window := c.RepetitionWindow
+	if window <= 0 {
+		window = defaultRepetitionWindow
+	}
+	var seen [256]bool
+	for _, ch := range text[max(0, len(text)-window):] {
+		seen[ch] = true
+	}
+	for ch := range dist {
+		if seen[ch] {
+			dist[ch] /= c.RepetitionPenalty
+		}
+	}
+}
+
+// applyPrimeBias applies PrimeBias to dist in place for the given generation step
+// (the number of bytes generated so far).
+func (c *Config) applyPrimeBias(dist map[byte]float64, step int) {
+	if len(c.PrimeBias) == 0 || step >= c.PrimeDecaySteps {
+		return
+	}
+	strength := 1 - float64(step)/float64(c.PrimeDecaySteps)
+	for ch, bias := range c.PrimeBias {
+		if w, ok := dist[ch]; ok {
+			dist[ch] = w * math.Exp(bias*strength)
+		}
+	}
+}
+
+// float64 draws a uniform value in [0, 1) from c.Rand or the global source.
+func (c *Config) float64() float64 {
+	if c != nil && c.uniform != nil {
+		return c.uniform()
+	}
+	if c != nil && c.Rand != nil {
+		return c.Rand.Float64()
+	}
+	return rand.Float64()
+}
+
+// intn draws a uniform value in [0, n) from c.Rand or the global source.
+func (c *Config) intn(n int) int {
+	if c != nil && c.Rand != nil {
+		return c.Rand.Intn(n)
+	}
+	return rand.Intn(n)
+}
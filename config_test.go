@@ -0,0 +1,449 @@
+package infinigram
+
+import (
+	"maps"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPrimeBias(t *testing.T) {
+	cfg := &Config{PrimeBias: map[byte]float64{'r': math.Log(8), 'z': 5}, PrimeDecaySteps: 4}
+	for _, tc := range []struct {
+		step  int
+		wantR float64
+	}{
+		{0, 8},            // full strength
+		{2, math.Sqrt(8)}, // half the log-bias
+		{4, 1}, {100, 1},  // gone
+	} {
+		dist := map[byte]float64{'r': 1, 'c': 1}
+		cfg.applyPrimeBias(dist, tc.step)
+		if math.Abs(dist['r']-tc.wantR) > 1e-12 || dist['c'] != 1 {
+			t.Errorf("step %d: weights %v, want r=%v and c unchanged", tc.step, dist, tc.wantR)
+		}
+		if _, ok := dist['z']; ok {
+			t.Errorf("step %d: biased byte 'z' added without a continuation", tc.step)
+		}
+	}
+
+	// In generation, the bias steers the first byte after "the " to 'r' far more often
+	idx := newTestIndex(t, testCorpus)
+	biased, plain := 0, 0
+	for seed := range int64(50) {
+		text, _ := GenerateWithConfig(idx, "the ", 5, 1, 3, &Config{Rand: rand.New(rand.NewSource(seed)), PrimeBias: map[byte]float64{'r': 4}, PrimeDecaySteps: 1})
+		if text[4] == 'r' {
+			biased++
+		}
+		text, _ = GenerateWithConfig(idx, "the ", 5, 1, 3, &Config{Rand: rand.New(rand.NewSource(seed))})
+		if text[4] == 'r' {
+			plain++
+		}
+	}
+	if biased < 40 || biased <= plain {
+		t.Errorf("'r' followed the prompt %d of 50 times with the bias, %d without", biased, plain)
+	}
+}
+
+func TestRecencyHalfLife(t *testing.T) {
+	// "a" is mostly followed by "b", but only by "c" near the end
+	idx := newTestIndex(t, strings.Repeat("ab ", 20)+"ac ac ")
+	dist, _, _ := BuildDistribution(idx, "a", 1, nil)
+	if dist['b'] <= dist['c'] {
+		t.Fatalf("without recency, weights b=%v c=%v, want b to dominate", dist['b'], dist['c'])
+	}
+	dist, _, _ = BuildDistribution(idx, "a", 1, &Config{RecencyHalfLife: 3})
+	if dist['c'] <= dist['b'] {
+		t.Errorf("with RecencyHalfLife 3, weights b=%v c=%v, want c to dominate", dist['b'], dist['c'])
+	}
+}
+
+func TestPhraseRun(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	cfg := &Config{PhraseMaxChunk: 8, PhraseMinFrequency: 2}
+	phrases := 0
+	for i := 1; i < len(testCorpus); i++ {
+		context := testCorpus[:i]
+		n := LongestSuffixMatch(idx, context)
+		run, count := cfg.phraseRun(idx, context, n)
+		if len(run) > 1 {
+			phrases++
+		}
+		if len(run) > cfg.PhraseMaxChunk {
+			t.Fatalf("%q: run %q is longer than PhraseMaxChunk", context, run)
+		}
+		// Every occurrence of the longest match continues with the run
+		suffix := context[len(context)-n:]
+		offsets := idx.Lookup([]byte(suffix), -1)
+		for _, off := range offsets {
+			if len(run) > 0 && !strings.HasPrefix(testCorpus[off+len(suffix):], string(run)) {
+				t.Errorf("%q: run %q, but %q is followed by %q at %d", context, run, suffix, testCorpus[off+len(suffix):], off)
+			}
+		}
+		if len(run) > 0 && (count != len(offsets) || count < cfg.PhraseMinFrequency) {
+			t.Errorf("%q: run %q with count=%d, want count=%d >= %d", context, run, count, len(offsets), cfg.PhraseMinFrequency)
+		}
+	}
+
+	if phrases == 0 {
+		t.Fatal("no multi-byte runs in the corpus")
+	}
+
+	// Phrase lookups go through the generation's lookup cache
+	cached := *cfg
+	cached.lookups = newLRUCache[[]int](16)
+	if run, _ := cached.phraseRun(idx, "sat o", 5); string(run) != "n " {
+		t.Fatalf("run after %q is %q, want %q", "sat o", run, "n ")
+	}
+	if _, ok := cached.lookups.get("sat o"); !ok {
+		t.Error("the phrase lookup wasn't cached")
+	}
+
+	// Greedy generation from the longest level copies deterministic regions anyway,
+	// so shortcuts must not change its output
+	for _, prompt := range []string{"the ", "a cat", "the rat ran"} {
+		want, _ := GenerateWithConfig(idx, prompt, 150, 0, 1, nil)
+		got, _ := GenerateWithConfig(idx, prompt, 150, 0, 1, cfg)
+		if got != want {
+			t.Errorf("%q: with phrase shortcuts %q, without %q", prompt, got, want)
+		}
+	}
+}
+
+func TestCircular(t *testing.T) {
+	// "xy" occurs only at the end of the corpus
+	idx := newTestIndex(t, "abxcxy")
+	if dist, _, _ := BuildDistribution(idx, "xy", 1, nil); dist != nil {
+		t.Errorf("without Circular, distribution after \"xy\" = %v, want none", dist)
+	}
+	dist, ns, matches := BuildDistribution(idx, "xy", 1, &Config{Circular: true})
+	if len(dist) != 1 || dist['a'] != 1 || ns[0] != 2 || matches[0] != 1 {
+		t.Errorf("with Circular, distribution after \"xy\" = %v (n=%v, matches %v), want the corpus's first byte once", dist, ns, matches)
+	}
+
+	// Matches that don't end the corpus are unaffected
+	plain, _, plainMatches := BuildDistribution(idx, "x", -1, nil)
+	wrapped, _, wrappedMatches := BuildDistribution(idx, "x", -1, &Config{Circular: true})
+	if !maps.Equal(plain, wrapped) || !slices.Equal(plainMatches, wrappedMatches) {
+		t.Errorf("after \"x\", which never ends the corpus, Circular changed %v to %v", plain, wrapped)
+	}
+}
+
+func TestLoadLevelWeights(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "weights.txt")
+	if err := os.WriteFile(path, []byte("0.5\n\n 2 \n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	weights, err := LoadLevelWeights(path)
+	if err != nil || !slices.Equal(weights, []float64{0.5, 2}) {
+		t.Fatalf("LoadLevelWeights = %v, %v; want [0.5 2]", weights, err)
+	}
+
+	// The loaded vector mixes two levels as 0.5*longest + 2*next
+	idx := newTestIndex(t, testCorpus)
+	context := "the dog sat on the "
+	longest, _, _ := BuildDistribution(idx, context, 2, &Config{LevelWeights: []float64{1}})
+	next, _, _ := BuildDistribution(idx, context, 2, &Config{LevelWeights: []float64{0, 1}})
+	got, _, _ := BuildDistribution(idx, context, 2, &Config{LevelWeights: weights})
+	decayed, _, _ := BuildDistribution(idx, context, 2, nil)
+	for ch := range got {
+		if want := 0.5*longest[ch] + 2*next[ch]; math.Abs(got[ch]-want) > 1e-9*want {
+			t.Errorf("weight of %q = %v, want %v", ch, got[ch], want)
+		}
+	}
+	if maps.Equal(got, decayed) {
+		t.Error("loaded weights gave the same distribution as the default decay")
+	}
+
+	for _, bad := range []string{"1\nx\n", "1\n-0.5\n", "NaN\n"} {
+		if err := os.WriteFile(path, []byte(bad), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadLevelWeights(path); err == nil {
+			t.Errorf("LoadLevelWeights(%q): no error", bad)
+		}
+	}
+}
+
+func TestAlpha(t *testing.T) {
+	// "xab" is always followed by c; only the shorter "ab" is ever followed by d
+	idx := newTestIndex(t, "xabc xabc xabc abd")
+	draws := func(alpha float64) int {
+		cfg := &Config{Alpha: alpha, Rand: rand.New(rand.NewSource(1))}
+		d := 0
+		for range 3000 {
+			if ch, _, _ := SampleWithConfig(idx, "xab", 0.3, 2, cfg); ch == 'd' {
+				d++
+			}
+		}
+		return d
+	}
+	without, with := draws(0), draws(1)
+	if without != 0 {
+		t.Errorf("without Alpha, d was drawn %d times at temp 0.3, want never", without)
+	}
+	if with == 0 {
+		t.Error("with Alpha 1, d was never drawn")
+	}
+
+	// The additive mass goes to every byte seen at any level, scaled by the weights
+	plain, _, _ := BuildDistribution(idx, "xab", 2, nil)
+	smoothed, _, _ := BuildDistribution(idx, "xab", 2, &Config{Alpha: 1})
+	for ch, w := range plain {
+		if want := w + 1 + defaultDecay; math.Abs(smoothed[ch]-want) > 1e-12 {
+			t.Errorf("weight of %q with Alpha 1 = %v, want %v", ch, smoothed[ch], want)
+		}
+	}
+}
+
+func TestDropShortLevelsThreshold(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	// "the dog sat on the " matches in full; "zq the " only up to "the "
+	long, short := "the dog sat on the ", "zq the "
+	_, allNs, _ := BuildDistribution(idx, long, -1, nil)
+	cfg := &Config{DropShortLevelsThreshold: 6}
+	_, ns, _ := BuildDistribution(idx, long, -1, cfg)
+	if len(ns) == 0 || len(ns) == len(allNs) {
+		t.Fatalf("levels n=%v with the threshold, %v without; want some but not all", ns, allNs)
+	}
+	for _, n := range ns {
+		if n < cfg.DropShortLevelsThreshold {
+			t.Errorf("level n=%d kept below the threshold; levels %v", n, ns)
+		}
+	}
+
+	// Without a long match there's nothing to protect, so every level stays
+	_, allNs, _ = BuildDistribution(idx, short, -1, nil)
+	if _, ns, _ := BuildDistribution(idx, short, -1, cfg); !slices.Equal(ns, allNs) {
+		t.Errorf("short match: levels n=%v, want all of %v", ns, allNs)
+	}
+}
+
+func TestMinProbFloor(t *testing.T) {
+	for _, floor := range []float64{0.01, 0.1, 0.3, 0.5} {
+		dist := map[byte]float64{'a': 900, 'b': 90, 'c': 9, 'd': 1}
+		cfg := &Config{MinProbFloor: floor}
+		cfg.applyProbFloor(dist, 1000)
+		var total float64
+		for ch, w := range dist {
+			// A floor above 1/n can't hold for every candidate, so it makes the draw uniform
+			if p := w / 1000; p < min(floor, 0.25)-1e-12 {
+				t.Errorf("floor %v: p(%q) = %v", floor, ch, p)
+			}
+			total += w
+		}
+		if math.Abs(total-1000) > 1e-9 {
+			t.Errorf("floor %v: weights sum to %v, want 1000", floor, total)
+		}
+		if len(dist) != 4 {
+			t.Errorf("floor %v: %d candidates, want 4", floor, len(dist))
+		}
+		if floor >= 0.25 && (dist['a'] != 250 || dist['d'] != 250) {
+			t.Errorf("floor %v: weights %v, want uniform", floor, dist)
+		}
+	}
+
+	// The floor holds in sampling too: a 1-in-1000 byte is drawn about 10% of the time
+	cfg := &Config{MinProbFloor: 0.1, Rand: rand.New(rand.NewSource(1))}
+	var rare int
+	for range 2000 {
+		if ch, _ := sampleWeighted(map[byte]float64{'a': 999, 'z': 1}, 1, cfg); ch == 'z' {
+			rare++
+		}
+	}
+	if got := float64(rare) / 2000; got < 0.08 || got > 0.13 {
+		t.Errorf("rare byte drawn %v of the time with a 0.1 floor", got)
+	}
+}
+
+func TestDedupeWindow(t *testing.T) {
+	// The first passage appears twice; a plain count sees "j" twice as often as "n"
+	idx := newTestIndex(t, "the quick fox jumps. the quick fox jumps. a quick fox naps. ")
+	dist, _, matches := BuildDistribution(idx, "quick fox ", 1, nil)
+	if dist['j'] != 2*dist['n'] || matches[0] != 3 {
+		t.Fatalf("without dedupe, weights j=%v n=%v over %v matches, want 2:1 over 3", dist['j'], dist['n'], matches)
+	}
+	dist, _, matches = BuildDistribution(idx, "quick fox ", 1, &Config{DedupeWindow: 4})
+	if dist['j'] != dist['n'] || matches[0] != 2 {
+		t.Errorf("with DedupeWindow 4, weights j=%v n=%v over %v matches, want 1:1 over 2", dist['j'], dist['n'], matches)
+	}
+}
+
+func TestTopK(t *testing.T) {
+	weights := map[byte]float64{'a': 5, 'b': 3, 'c': 1, 'd': 1}
+	for _, tc := range []struct {
+		k    int
+		want string
+	}{
+		{1, "a"},
+		{2, "ab"},
+		{3, "abc"}, // c and d tie at the cut, so the smaller byte stays
+		{4, "abcd"},
+		{0, "abcd"},
+	} {
+		dist := maps.Clone(weights)
+		kept := (&Config{TopK: tc.k}).truncate([]byte("abcd"), dist)
+		if string(kept) != tc.want || len(dist) != len(tc.want) {
+			t.Errorf("TopK %d kept %q with %d weights left, want %q", tc.k, kept, len(dist), tc.want)
+		}
+	}
+
+	// Only the kept candidates are drawn, even at a high temperature
+	for seed := range int64(200) {
+		if ch, _ := sampleWeighted(maps.Clone(weights), 3, &Config{TopK: 2, Rand: rand.New(rand.NewSource(seed))}); ch != 'a' && ch != 'b' {
+			t.Fatalf("seed %d: TopK 2 drew %q", seed, ch)
+		}
+	}
+}
+
+func TestTopP(t *testing.T) {
+	weights := map[byte]float64{'a': 5, 'b': 3, 'c': 1, 'd': 1}
+	for _, tc := range []struct {
+		p    float64
+		want string
+	}{
+		{0.5, "a"},
+		{0.6, "ab"},
+		{0.85, "abc"},
+		{1, "abcd"},
+		{0, "abcd"},
+	} {
+		dist := maps.Clone(weights)
+		kept := (&Config{TopP: tc.p}).truncate([]byte("abcd"), dist)
+		if string(kept) != tc.want || len(dist) != len(tc.want) {
+			t.Errorf("TopP %v kept %q with %d weights left, want %q", tc.p, kept, len(dist), tc.want)
+		}
+	}
+
+	// TopP 1 draws exactly as without the option
+	for seed := range int64(20) {
+		want, _ := sampleWeighted(maps.Clone(weights), 3, &Config{Rand: rand.New(rand.NewSource(seed))})
+		got, _ := sampleWeighted(maps.Clone(weights), 3, &Config{TopP: 1, Rand: rand.New(rand.NewSource(seed))})
+		if got != want {
+			t.Errorf("seed %d: TopP 1 drew %q, without it %q", seed, got, want)
+		}
+	}
+	// And a cut candidate is never drawn, even at a high temperature
+	for seed := range int64(50) {
+		if ch, _ := sampleWeighted(maps.Clone(weights), 3, &Config{TopP: 0.6, Rand: rand.New(rand.NewSource(seed))}); ch != 'a' && ch != 'b' {
+			t.Errorf("seed %d: TopP 0.6 drew %q", seed, ch)
+		}
+	}
+}
+
+func TestRepetitionPenalty(t *testing.T) {
+	// "a" is only ever followed by "a", so it is the sole candidate however penalized
+	idx := newTestIndex(t, strings.Repeat("a", 50))
+	if text, _ := GenerateWithConfig(idx, "a", 20, 1, 3, &Config{RepetitionPenalty: 100}); text != strings.Repeat("a", 20) {
+		t.Errorf("penalized sole candidate generated %q, want 20 a's", text)
+	}
+
+	// A penalty of 1 or less is off
+	idx = newTestIndex(t, testCorpus)
+	for seed := range int64(5) {
+		want, _ := GenerateWithConfig(idx, "the ", 100, 1, 3, &Config{Rand: rand.New(rand.NewSource(seed))})
+		for _, penalty := range []float64{-1, 0, 0.5, 1} {
+			cfg := &Config{RepetitionPenalty: penalty, Rand: rand.New(rand.NewSource(seed))}
+			if got, _ := GenerateWithConfig(idx, "the ", 100, 1, 3, cfg); got != want {
+				t.Errorf("seed %d: penalty %v generated %q, want %q", seed, penalty, got, want)
+			}
+		}
+	}
+}
+
+func TestInterpolation(t *testing.T) {
+	levels := []level{
+		{counts: map[byte]float64{'a': 1, 'b': 1}, numMatches: 2, n: 2},
+		{counts: map[byte]float64{'a': 1, 'c': 9}, numMatches: 10, n: 1},
+	}
+	// 0.75*{a:.5, b:.5} + 0.25*{a:.1, c:.9}
+	got, _, _ := combineLevels(levels, &Config{Interpolation: []float64{3, 1}})
+	want := map[byte]float64{'a': 0.4, 'b': 0.375, 'c': 0.225}
+	if !maps.EqualFunc(got, want, func(x, y float64) bool { return math.Abs(x-y) < 1e-12 }) {
+		t.Errorf("interpolated %v, want %v", got, want)
+	}
+
+	// Fewer lambdas than levels falls back to decay
+	got, _, _ = combineLevels(levels, &Config{Interpolation: []float64{1}})
+	want, _, _ = combineLevels(levels, nil)
+	if !maps.Equal(got, want) {
+		t.Errorf("with one lambda for two levels mixed %v, want the decayed %v", got, want)
+	}
+}
+
+func TestMinMatches(t *testing.T) {
+	// "yab" occurs once, "ab" three times and "b" five times
+	idx := newTestIndex(t, "xab. yab. zab. wb. vb.")
+	_, ns, _ := BuildDistribution(idx, "yab", 2, nil)
+	if !slices.Equal(ns, []int{3, 2}) {
+		t.Fatalf("without MinMatches, levels %v, want [3 2]", ns)
+	}
+	// The skipped level doesn't use up one of the k=2 levels
+	_, ns, matches := BuildDistribution(idx, "yab", 2, &Config{MinMatches: 2})
+	if !slices.Equal(ns, []int{2, 1}) || !slices.Equal(matches, []int{3, 5}) {
+		t.Errorf("with MinMatches 2, levels %v with %v matches, want [2 1] with [3 5]", ns, matches)
+	}
+	_, ns, _ = BuildDistribution(idx, "yab", 2, &Config{MinMatches: 4})
+	if !slices.Equal(ns, []int{1}) {
+		t.Errorf("with MinMatches 4, levels %v, want [1]", ns)
+	}
+	if dist, _, _ := BuildDistribution(idx, "yab", 2, &Config{MinMatches: 6}); dist != nil {
+		t.Errorf("with MinMatches above every count, got %v, want no distribution", dist)
+	}
+}
+
+func TestContextWindow(t *testing.T) {
+	// A long passage that never repeats, so a match can run as long as the window
+	corpus := make([]byte, 400)
+	rng := rand.New(rand.NewSource(1))
+	for i := range corpus {
+		corpus[i] = "abcdefghijklmnopqrstuvwxyz"[rng.Intn(26)]
+	}
+	idx := newTestIndex(t, string(corpus))
+	prompt := string(corpus[:300])
+	for _, tc := range []struct {
+		window, wantN int
+	}{
+		{0, defaultContextWindow},
+		{10, 10},
+		{-1, 300},
+	} {
+		tokens := GenerateTokens(idx, prompt, len(prompt)+1, 0, 1, &Config{ContextWindow: tc.window})
+		if len(tokens) != 1 || tokens[0].N != tc.wantN || tokens[0].Byte != corpus[300] {
+			t.Errorf("ContextWindow %d: generated %+v, want %q from an n=%d match", tc.window, tokens, corpus[300], tc.wantN)
+		}
+	}
+}
+
+func TestEOS(t *testing.T) {
+	idx := newTestIndex(t, "Title: cats\x00Title: dogs\x00Title: rats\x00")
+	// The context is cut at its last boundary, so no match reaches the previous document
+	_, ns, _ := BuildDistribution(idx, "cats\x00Ti", -1, nil)
+	if ns[0] != len("cats\x00Ti") {
+		t.Fatalf("without EOS the longest level is n=%d, want %d", ns[0], len("cats\x00Ti"))
+	}
+	_, ns, _ = BuildDistribution(idx, "cats\x00Ti", -1, &Config{EOS: true})
+	if ns[0] != len("\x00Ti") {
+		t.Errorf("with EOS the longest level is n=%d, want %d", ns[0], len("\x00Ti"))
+	}
+	if dist, _, _ := BuildDistribution(idx, "dogs\x00", -1, &Config{EOS: true}); len(dist) != 1 || dist['T'] == 0 {
+		t.Errorf("after a boundary got %v, want the byte every document starts with", dist)
+	}
+}
+
+func TestStopAtEOS(t *testing.T) {
+	idx := newTestIndex(t, "Title: cats\x00Title: dogs\x00Title: rats\x00")
+	text, _ := GenerateWithConfig(idx, "Title: c", 100, 0, 3, &Config{EOS: true, StopAtEOS: true})
+	if text != "Title: cats" {
+		t.Errorf("with StopAtEOS generated %q, want %q", text, "Title: cats")
+	}
+	text, _ = GenerateWithConfig(idx, "Title: c", 100, 0, 3, &Config{EOS: true})
+	if !strings.HasPrefix(text, "Title: cats\x00Title: ") {
+		t.Errorf("without StopAtEOS generated %q, want a new document after the boundary", text)
+	}
+}
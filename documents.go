@@ -0,0 +1,56 @@
+package infinigram
+
+import (
+	"bytes"
+	"index/suffixarray"
+	"sort"
+)
+
+// DocumentModel indexes a corpus made of documents joined by a separator and can map
+// any corpus offset (e.g. one returned by Index.Lookup) back to the document it is in.
+type DocumentModel struct {
+	Index *suffixarray.Index
+	// starts[i] and ends[i] delimit document i within Index.Bytes()
+	starts, ends []int
+}
+
+// NewDocumentModel indexes corpus as a whole and records the byte range of each
+// document, where documents are separated by sep. An empty sep treats the corpus
+// as a single document.
+func NewDocumentModel(corpus, sep []byte) *DocumentModel {
+	m := &DocumentModel{Index: suffixarray.New(corpus)}
+	start := 0
+	for len(sep) > 0 {
+		i := bytes.Index(corpus[start:], sep)
+		if i < 0 {
+			break
+		}
+		m.starts = append(m.starts, start)
+		m.ends = append(m.ends, start+i)
+		start += i + len(sep)
+	}
+	m.starts = append(m.starts, start)
+	m.ends = append(m.ends, len(corpus))
+	return m
+}
+
+// NumDocuments returns the number of documents in the corpus.
+func (m *DocumentModel) NumDocuments() int {
+	return len(m.starts)
+}
+
+// Document returns the bytes of document i, without separators.
+func (m *DocumentModel) Document(i int) []byte {
+	return m.Index.Bytes()[m.starts[i]:m.ends[i]]
+}
+
+// DocumentOf returns the index of the document containing the corpus offset, or -1 if
+// the offset falls on a separator or outside the corpus.
+func (m *DocumentModel) DocumentOf(offset int) int {
+	// Last document starting at or before offset
+	i := sort.SearchInts(m.starts, offset+1) - 1
+	if i < 0 || offset >= m.ends[i] {
+		return -1
+	}
+	return i
+}
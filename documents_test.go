@@ -0,0 +1,34 @@
+package infinigram
+
+import "testing"
+
+func TestDocumentOf(t *testing.T) {
+	// Documents "cat", "dog" and "bird" at offsets 0-2, 5-7 and 10-13
+	m := NewDocumentModel([]byte("cat||dog||bird"), []byte("||"))
+	if n := m.NumDocuments(); n != 3 {
+		t.Fatalf("NumDocuments = %d, want 3", n)
+	}
+	for _, tc := range []struct{ offset, want int }{
+		{-1, -1}, {0, 0}, {2, 0}, {3, -1}, {4, -1}, {5, 1}, {7, 1}, {8, -1}, {10, 2}, {13, 2}, {14, -1},
+	} {
+		if got := m.DocumentOf(tc.offset); got != tc.want {
+			t.Errorf("DocumentOf(%d) = %d, want %d", tc.offset, got, tc.want)
+		}
+	}
+	for _, off := range m.Index.Lookup([]byte("o"), -1) {
+		if got := m.DocumentOf(off); got != 1 {
+			t.Errorf("\"o\" at offset %d is in document %d, want 1", off, got)
+		}
+	}
+	if got := string(m.Document(2)); got != "bird" {
+		t.Errorf("Document(2) = %q, want %q", got, "bird")
+	}
+
+	// Empty documents count, and an empty separator means one document
+	if n := NewDocumentModel([]byte("||a||"), []byte("||")).NumDocuments(); n != 3 {
+		t.Errorf("NumDocuments with empty documents = %d, want 3", n)
+	}
+	if n := NewDocumentModel([]byte("a||b"), nil).NumDocuments(); n != 1 {
+		t.Errorf("NumDocuments with no separator = %d, want 1", n)
+	}
+}
@@ -0,0 +1,21 @@
+package infinigram
+
+import "errors"
+
+// Errors returned by the package, for use with errors.Is. Functions may wrap them with
+// more detail. Sampling and generation never fail: they report a context with no
+// match through their results (a false ok, a nil distribution, or generation simply
+// ending), and decode greedily at a temperature of zero or less, or NaN.
+var (
+	// ErrEmptyCorpus means a model was built from a corpus with no bytes, by
+	// NewIndexFromReaders or NewChunkedModel.
+	ErrEmptyCorpus = errors.New("infini-gram: empty corpus")
+	// ErrNoMatch means no suffix of the context occurs in the corpus, from
+	// DistributionCSV.
+	ErrNoMatch = errors.New("infini-gram: no suffix of the context matches the corpus")
+	// ErrInvalidTemperature means a temperature was NaN where one is required, in
+	// DistributionCSV.
+	ErrInvalidTemperature = errors.New("infini-gram: invalid temperature")
+	// ErrCorruptIndex means a serialized index could not be decoded by LoadIndex.
+	ErrCorruptIndex = errors.New("infini-gram: corrupt index")
+)
@@ -0,0 +1,79 @@
+package infinigram
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestErrEmptyCorpus(t *testing.T) {
+	if _, err := NewIndexFromReaders(nil); !errors.Is(err, ErrEmptyCorpus) {
+		t.Errorf("no readers: %v, want ErrEmptyCorpus", err)
+	}
+	if _, err := NewIndexFromReaders(nil, strings.NewReader(""), strings.NewReader("")); !errors.Is(err, ErrEmptyCorpus) {
+		t.Errorf("empty readers: %v, want ErrEmptyCorpus", err)
+	}
+	if _, err := NewIndexFromReaders([]byte("|"), strings.NewReader(""), strings.NewReader("")); err != nil {
+		t.Errorf("empty readers with a separator: %v, want the separator alone indexed", err)
+	}
+}
+
+func TestErrNoMatchAndInvalidTemperature(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	if err := DistributionCSV(idx, "zq", 1, 3, io.Discard); !errors.Is(err, ErrNoMatch) {
+		t.Errorf("unmatched context: %v, want ErrNoMatch", err)
+	}
+	if err := DistributionCSV(idx, "the ", math.NaN(), 3, io.Discard); !errors.Is(err, ErrInvalidTemperature) {
+		t.Errorf("NaN temperature: %v, want ErrInvalidTemperature", err)
+	}
+}
+
+func TestErrCorruptIndex(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "corpus.idx")
+	if err := SaveIndex(newTestIndex(t, testCorpus), path); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := len(indexMagic) + 64 + 1
+
+	for name, data := range map[string][]byte{
+		"not an index": []byte("the cat sat on the mat"),
+		"empty":        nil,
+		"no hash":      []byte(indexMagic),
+		"truncated":    saved[:len(saved)/2],
+		"no checksum":  saved[:len(saved)-1],
+		"altered":      flipByte(saved, header+10),
+		"wrong hash":   flipByte(saved, len(indexMagic)),
+		"huge length":  append(append([]byte{}, saved[:header]...), 0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f),
+	} {
+		corrupt := filepath.Join(dir, "corrupt.idx")
+		if err := os.WriteFile(corrupt, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadIndex(corrupt); !errors.Is(err, ErrCorruptIndex) {
+			t.Errorf("%s: %v, want ErrCorruptIndex", name, err)
+		}
+	}
+
+	// A missing file is an ordinary I/O error
+	if _, err := LoadIndex(filepath.Join(dir, "missing.idx")); !errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrCorruptIndex) {
+		t.Errorf("missing file: %v, want a plain not-exist error", err)
+	}
+}
+
+// flipByte returns a copy of data with the byte at i changed.
+func flipByte(data []byte, i int) []byte {
+	data = bytes.Clone(data)
+	data[i] ^= 0x01
+	return data
+}
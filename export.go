@@ -0,0 +1,60 @@
+package infinigram
+
+import (
+	"encoding/csv"
+	"fmt"
+	"index/suffixarray"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// DistributionCSV writes the next-byte distribution after context as CSV rows of
+// byte,probability, most probable first, after a header row. Printable ASCII bytes
+// are written as themselves; all others (including space) as a hex code like 0x0a.
+// If no suffix of context matches, only the header is written and ErrNoMatch is
+// returned. A NaN temp yields ErrInvalidTemperature.
+func DistributionCSV(idx *suffixarray.Index, context string, temp float64, k int, w io.Writer) error {
+	if math.IsNaN(temp) {
+		return ErrInvalidTemperature
+	}
+	logDist, _, _ := NextLogDistribution(idx, context, temp, k)
+	chars := make([]byte, 0, len(logDist))
+	for ch := range logDist {
+		chars = append(chars, ch)
+	}
+	sort.Slice(chars, func(i, j int) bool {
+		if logDist[chars[i]] != logDist[chars[j]] {
+			return logDist[chars[i]] > logDist[chars[j]]
+		}
+		return chars[i] < chars[j]
+	})
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"byte", "probability"}); err != nil {
+		return err
+	}
+	for _, ch := range chars {
+		p := strconv.FormatFloat(math.Exp(logDist[ch]), 'g', -1, 64)
+		if err := cw.Write([]string{csvByte(ch), p}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	if logDist == nil {
+		return ErrNoMatch
+	}
+	return nil
+}
+
+// csvByte renders b for DistributionCSV.
+func csvByte(b byte) string {
+	if b > ' ' && b < 0x7f {
+		return string(b)
+	}
+	return fmt.Sprintf("0x%02x", b)
+}
@@ -0,0 +1,53 @@
+package infinigram
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestDistributionCSV(t *testing.T) {
+	// "a" is followed by b twice and c once; "b" by a newline and a space
+	idx := newTestIndex(t, "ab\nab ac")
+	for _, tc := range []struct {
+		context string
+		bytes   []string
+		probs   []float64
+	}{
+		{"a", []string{"b", "c"}, []float64{2.0 / 3, 1.0 / 3}},
+		{"b", []string{"0x0a", "0x20"}, []float64{0.5, 0.5}},
+	} {
+		var buf bytes.Buffer
+		if err := DistributionCSV(idx, tc.context, 1, 1, &buf); err != nil {
+			t.Fatalf("%q: %v", tc.context, err)
+		}
+		rows, err := csv.NewReader(&buf).ReadAll()
+		if err != nil {
+			t.Fatalf("%q: output isn't CSV: %v", tc.context, err)
+		}
+		if !slices.Equal(rows[0], []string{"byte", "probability"}) {
+			t.Errorf("%q: header %q", tc.context, rows[0])
+		}
+		if len(rows)-1 != len(tc.bytes) {
+			t.Fatalf("%q: %d rows, want %d", tc.context, len(rows)-1, len(tc.bytes))
+		}
+		for i, row := range rows[1:] {
+			p, err := strconv.ParseFloat(row[1], 64)
+			if row[0] != tc.bytes[i] || err != nil || math.Abs(p-tc.probs[i]) > 1e-12 {
+				t.Errorf("%q: row %d is %q, want %s,%v", tc.context, i+1, row, tc.bytes[i], tc.probs[i])
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := DistributionCSV(idx, "z", 1, 1, &buf); !errors.Is(err, ErrNoMatch) || buf.String() != "byte,probability\n" {
+		t.Errorf("no match: wrote %q, %v; want only the header and ErrNoMatch", buf.String(), err)
+	}
+	if err := DistributionCSV(idx, "a", math.NaN(), 1, &buf); !errors.Is(err, ErrInvalidTemperature) {
+		t.Errorf("NaN temperature: %v, want ErrInvalidTemperature", err)
+	}
+}
@@ -0,0 +1,155 @@
+package infinigram
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"index/suffixarray"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+)
+
+// NewLimitedIndex indexes at most limit bytes of data, trading coverage for build time
+// and memory on large corpora. With a nil r it keeps the first limit bytes; otherwise
+// it keeps a contiguous window at an offset drawn from r, so n-grams inside the window
+// stay intact. The model's statistics then describe only that part of the corpus. A
+// limit <= 0 or >= len(data) indexes everything.
+func NewLimitedIndex(data []byte, limit int, r *rand.Rand) *suffixarray.Index {
+	return suffixarray.New(LimitCorpus(data, limit, r))
+}
+
+// LimitCorpus returns the part of data that NewLimitedIndex indexes, drawing the
+// window's offset from r in the same way.
+func LimitCorpus(data []byte, limit int, r *rand.Rand) []byte {
+	if limit <= 0 || limit >= len(data) {
+		return data
+	}
+	start := 0
+	if r != nil {
+		start = r.Intn(len(data) - limit + 1)
+	}
+	return data[start : start+limit]
+}
+
+// NewIndexFromReaders indexes the concatenation of everything read from rs, such as
+// several files or os.Stdin. If sep is non-empty it is inserted between consecutive
+// inputs, and it is an error for any input to contain sep.
+//
+// The separator is part of the corpus, so it is a possible continuation wherever a
+// context matches the end of an input, and Generate can emit it. Pick a sequence that
+// never occurs in real text (a single 0x00 byte, say) so it can't be confused with it,
+// and trim generated text at its first occurrence, or exclude it with Config.Allowed.
+// Without a separator, n-grams spanning the end of one input and the start of the next
+// are indexed as if they were real text. Empty input yields ErrEmptyCorpus.
+func NewIndexFromReaders(sep []byte, rs ...io.Reader) (*suffixarray.Index, error) {
+	var buf bytes.Buffer
+	for i, r := range rs {
+		if i > 0 {
+			buf.Write(sep)
+		}
+		start := buf.Len()
+		if _, err := buf.ReadFrom(r); err != nil {
+			return nil, err
+		}
+		if len(sep) > 0 && bytes.Contains(buf.Bytes()[start:], sep) {
+			return nil, fmt.Errorf("input %d contains the separator %q", i, sep)
+		}
+	}
+	if buf.Len() == 0 {
+		return nil, ErrEmptyCorpus
+	}
+	return suffixarray.New(buf.Bytes()), nil
+}
+
+// indexMagic starts every file written by SaveIndex.
+const indexMagic = "infini-gram index v1\n"
+
+// SaveIndex writes idx, including its corpus, to path so LoadIndex can restore it
+// without rebuilding the suffix array. The file is the magic line, the corpus hash
+// (see CorpusHash) on its own line, the index in suffixarray.Index.Write format, and a
+// SHA-256 checksum of that index. It is written to a temporary file and renamed into
+// place, so an interrupted save never leaves a truncated index at path.
+func SaveIndex(idx *suffixarray.Index, path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // no-op once renamed
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "%s%s\n", indexMagic, CorpusHash(idx.Bytes()))
+	sum := sha256.New()
+	if err := idx.Write(io.MultiWriter(w, sum)); err != nil {
+		f.Close()
+		return err
+	}
+	w.Write(sum.Sum(nil))
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadIndex reads an index written by SaveIndex. A file that is truncated, altered, or
+// not an index at all yields an error wrapping ErrCorruptIndex.
+func LoadIndex(path string) (*suffixarray.Index, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	idx, err := readIndex(bufio.NewReader(f), fi.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return idx, nil
+}
+
+// readIndex decodes the SaveIndex format from r, which holds size bytes.
+func readIndex(r *bufio.Reader, size int64) (idx *suffixarray.Index, err error) {
+	magic := make([]byte, len(indexMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != indexMagic {
+		return nil, fmt.Errorf("%w: not an infini-gram index", ErrCorruptIndex)
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("%w: missing corpus hash", ErrCorruptIndex)
+	}
+	hash := line[:len(line)-1]
+
+	// suffixarray.Index.Read trusts the corpus length it reads and allocates that much
+	// up front, so check it against the file size before letting it
+	head, _ := r.Peek(binary.MaxVarintLen64)
+	if n, _ := binary.Varint(head); n < 0 || n > size {
+		return nil, fmt.Errorf("%w: corpus length %d exceeds file size", ErrCorruptIndex, n)
+	}
+	sum := sha256.New()
+	idx = new(suffixarray.Index)
+	if err := idx.Read(io.TeeReader(r, sum)); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptIndex, err)
+	}
+	want := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, want); err != nil || !bytes.Equal(sum.Sum(nil), want) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptIndex)
+	}
+	if CorpusHash(idx.Bytes()) != hash {
+		return nil, fmt.Errorf("%w: corpus hash mismatch", ErrCorruptIndex)
+	}
+	return idx, nil
+}
@@ -0,0 +1,57 @@
+package infinigram
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveIndexRecordsCorpusHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "corpus.idx")
+	idx := newTestIndex(t, testCorpus)
+	if err := SaveIndex(idx, path); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := indexMagic + CorpusHash([]byte(testCorpus)) + "\n"
+	if !bytes.HasPrefix(saved, []byte(header)) {
+		t.Errorf("saved index starts %q, want %q", saved[:min(len(saved), len(header))], header)
+	}
+
+	loaded, err := LoadIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if CorpusHash(loaded.Bytes()) != CorpusHash(idx.Bytes()) {
+		t.Error("the loaded index holds a different corpus")
+	}
+}
+
+func TestNewLimitedIndex(t *testing.T) {
+	data := []byte(testCorpus)
+	for _, limit := range []int{1, 10, 100, len(data) - 1} {
+		if got := len(NewLimitedIndex(data, limit, nil).Bytes()); got != limit {
+			t.Errorf("limit %d: indexed %d bytes", limit, got)
+		}
+		if got := string(NewLimitedIndex(data, limit, nil).Bytes()); got != testCorpus[:limit] {
+			t.Errorf("limit %d: indexed %q, want the corpus prefix", limit, got)
+		}
+		// A random window is contiguous and just as long
+		r := rand.New(rand.NewSource(int64(limit)))
+		window := string(NewLimitedIndex(data, limit, r).Bytes())
+		if len(window) != limit || !strings.Contains(testCorpus, window) {
+			t.Errorf("limit %d: random window %q isn't %d corpus bytes", limit, window, limit)
+		}
+	}
+	for _, limit := range []int{0, -1, len(data), 2 * len(data)} {
+		if got := len(NewLimitedIndex(data, limit, nil).Bytes()); got != len(data) {
+			t.Errorf("limit %d: indexed %d bytes, want all %d", limit, got, len(data))
+		}
+	}
+}
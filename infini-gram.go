@@ -1,110 +1,691 @@
-package main
+// Package infinigram implements an infini-gram language model over bytes: the next
+// byte is predicted by finding suffixes of the context in a corpus indexed by
+// index/suffixarray and mixing the continuations of several match lengths, longer
+// matches weighted more heavily. Callers build the index themselves, typically with
+// suffixarray.New over the training text, and pass it to Generate, Sample,
+// Perplexity and the other functions.
+package infinigram
 
 import (
+	"bytes"
 	"fmt"
 	"index/suffixarray"
+	"log/slog"
+	"maps"
 	"math"
 	"math/rand"
-	"os"
-	"sort"
+	"slices"
 	"time"
+	"unicode/utf8"
 )
 
-// buildDistribution builds the combined probability distribution from n-gram levels.
+// BuildDistribution builds the combined probability distribution from n-gram levels.
 // Returns the unnormalized distribution and per-level stats (n values and match counts).
-// k=-1 uses all levels (down to n=1).
-func buildDistribution(idx *suffixarray.Index, context string, k int) (map[byte]float64, []int, []int) {
+// k<0 (conventionally -1) uses all levels (down to n=1) and k=0 picks the levels
+// automatically (see Config.MaxMatchThreshold). A nil cfg uses the default settings.
+func BuildDistribution(idx *suffixarray.Index, context string, k int, cfg *Config) (map[byte]float64, []int, []int) {
+	return combineLevels(findLevels(idx, context, k, cfg, -1), cfg)
+}
+
+// level holds the continuations of one matched suffix of the context. counts is
+// usually the raw count per byte but may be reweighted (see Config.RecencyHalfLife);
+// numMatches is always the raw number of continuations.
+type level struct {
+	counts     map[byte]float64
+	numMatches int
+	n          int
+}
+
+// findLevels looks up suffixes of context from longest to shortest and keeps those
+// whose number of continuations strictly increases, up to k levels (k<0 for all,
+// k=0 for auto). A continuation at corpus position exclude is ignored; pass -1 to
+// keep them all.
+func findLevels(idx *suffixarray.Index, context string, k int, cfg *Config, exclude int) []level {
+	context = cfg.document(context)
+	return findLevelsFrom(idx, context, LongestSuffixMatch(idx, context), k, cfg, exclude)
+}
+
+// findLevelsFrom is findLevels given longest, the length of the longest suffix of
+// context that occurs in the corpus. No longer suffix can match, so the search starts
+// there rather than looking up every longer suffix of a long context.
+func findLevelsFrom(idx *suffixarray.Index, context string, longest, k int, cfg *Config, exclude int) []level {
 	data := idx.Bytes()
-	type level struct {
-		counts     map[byte]int
-		numMatches int
-		n          int
-	}
 	var levels []level
 	lastNumMatches := 0
+	allowed, restricted := cfg.allowedSet()
 
-	for i := 0; i < len(context) && (k < 0 || len(levels) < k); i++ {
-		offsets := idx.Lookup([]byte(context[i:]), -1)
+	first := max(cfg.firstSuffix(context), len(context)-longest)
+	for i := first; i < len(context) && (k <= 0 || len(levels) < k); i++ {
+		offsets := cfg.lookup(idx, context[i:])
 		if len(offsets) == 0 {
 			continue
 		}
-		counts := make(map[byte]int)
+		counts := make(map[byte]float64)
 		n := len(context) - i
+		numMatches := 0
+		sample := reservoir{size: cfg.maxOffsets(), cfg: cfg}
+		var seen map[string]bool
+		if cfg.dedupeWindow() > 0 {
+			seen = make(map[string]bool)
+		}
 		for _, off := range offsets {
-			if pos := off + n; pos < len(data) {
-				counts[data[pos]]++
+			pos := off + n
+			if pos == len(data) && cfg.circular() {
+				pos = 0
+			}
+			if pos < len(data) && pos != exclude && (!restricted || allowed[data[pos]]) {
+				if seen != nil {
+					// Copies of a duplicated passage share the bytes before the match
+					key := string(data[max(0, off-cfg.DedupeWindow):off]) + string(data[pos])
+					if seen[key] {
+						continue
+					}
+					seen[key] = true
+				}
+				numMatches++
+				if sample.size > 0 {
+					sample.add(pos)
+					continue
+				}
+				counts[data[pos]] += cfg.recencyWeight(pos, len(data))
 			}
 		}
-		numMatches := 0
-		for _, c := range counts {
-			numMatches += c
+		if len(sample.items) > 0 {
+			// Scale the subsample back up so counts stay comparable across levels
+			scale := float64(sample.seen) / float64(len(sample.items))
+			for _, pos := range sample.items {
+				counts[data[pos]] += scale * cfg.recencyWeight(pos, len(data))
+			}
 		}
-		if numMatches > lastNumMatches {
-			levels = append(levels, level{counts, numMatches, n})
-			lastNumMatches = numMatches
+		if numMatches <= lastNumMatches || cfg.tooRare(numMatches) {
+			continue
+		}
+		// Auto mode: a level this common is too generic to help, and every shorter
+		// level has even more matches, so stop (but always keep one level)
+		if k == 0 && cfg.tooGeneric(numMatches) && len(levels) > 0 {
+			break
 		}
+		levels = append(levels, level{counts, numMatches, n})
+		lastNumMatches = numMatches
 	}
+	return cfg.dropShortLevels(levels)
+}
+
+// reservoir keeps a uniform random sample of up to size values from a stream of
+// unknown length (Algorithm R), drawing from cfg.Rand.
+type reservoir struct {
+	items []int
+	seen  int
+	size  int
+	cfg   *Config
+}
+
+func (r *reservoir) add(v int) {
+	r.seen++
+	if len(r.items) < r.size {
+		r.items = append(r.items, v)
+		return
+	}
+	if j := r.cfg.intn(r.seen); j < r.size {
+		r.items[j] = v
+	}
+}
+
+// combineLevels mixes the levels' continuation counts, weighting them by
+// cfg.levelWeights (exponential decay by default), and returns the unnormalized
+// distribution and per-level n values and match counts.
+func combineLevels(levels []level, cfg *Config) (map[byte]float64, []int, []int) {
+	return combineLevelsInto(nil, levels, cfg)
+}
+
+// combineLevelsInto is combineLevels writing the distribution into dst, which is
+// cleared first so it can be reused across steps. A nil dst allocates a new map.
+func combineLevelsInto(dst map[byte]float64, levels []level, cfg *Config) (map[byte]float64, []int, []int) {
 	if len(levels) == 0 {
 		return nil, nil, nil
 	}
 
-	// Combine distributions with exponential decay
-	combined := make(map[byte]float64)
+	combined := dst
+	if combined == nil {
+		combined = make(map[byte]float64)
+	} else {
+		clear(combined)
+	}
 	nValues := make([]int, len(levels))
 	matchCounts := make([]int, len(levels))
-	decay := 0.1
+	weights := cfg.levelWeights(levels)
 	for i, lvl := range levels {
 		nValues[i] = lvl.n
 		matchCounts[i] = lvl.numMatches
-		w := math.Pow(decay, float64(i))
+		w := weights[i]
+		if w == 0 {
+			continue
+		}
 		for ch, cnt := range lvl.counts {
-			combined[ch] += w * float64(cnt)
+			combined[ch] += w * cnt
+		}
+	}
+
+	if alpha := cfg.alpha(); alpha > 0 {
+		// Every byte seen at any level gets alpha at every level, so the longest match
+		// no longer rules out what shorter ones allow
+		var total float64
+		for _, w := range weights {
+			total += w
+		}
+		for ch := range combined {
+			combined[ch] += total * alpha
 		}
 	}
 	return combined, nValues, matchCounts
 }
 
 // Sample returns the next byte sampled from k n-gram levels, plus the n and numMatches at each level.
+// It draws from the global math/rand source; use SampleWithRand for reproducible draws.
 func Sample(idx *suffixarray.Index, context string, temp float64, k int) (byte, []int, []int) {
-	combined, nValues, matchCounts := buildDistribution(idx, context, k)
+	return SampleWithRand(idx, context, temp, k, nil)
+}
+
+// SampleWithRand is like Sample but draws from r, or the global source if r is nil.
+// The same r state, context and parameters always give the same byte. For whole
+// generations, set Config.Rand and use GenerateWithConfig.
+func SampleWithRand(idx *suffixarray.Index, context string, temp float64, k int, r *rand.Rand) (byte, []int, []int) {
+	return SampleWithConfig(idx, context, temp, k, &Config{Rand: r})
+}
+
+// SampleWithConfig is like Sample but takes optional settings, such as Config.TopK and
+// Config.TopP. A nil cfg behaves like Sample.
+func SampleWithConfig(idx *suffixarray.Index, context string, temp float64, k int, cfg *Config) (byte, []int, []int) {
+	combined, nValues, matchCounts := BuildDistribution(idx, context, k, cfg)
 	if combined == nil {
 		return 0, nil, nil
 	}
+	ch, ok := sampleWeighted(combined, temp, cfg)
+	if !ok {
+		return 0, nil, nil
+	}
+	return ch, nValues, matchCounts
+}
+
+// NextLogDistribution returns the natural-log probability of each possible next byte
+// after context, with temperature applied, plus the per-level n values and match
+// counts. It works in log space with a stable log-sum-exp, so sharp distributions on
+// large corpora don't underflow. A temp <= 0 (or NaN) spreads all mass over the
+// highest-weighted bytes. It returns nil if no suffix of context matches.
+func NextLogDistribution(idx *suffixarray.Index, context string, temp float64, k int) (map[byte]float64, []int, []int) {
+	combined, nValues, matchCounts := BuildDistribution(idx, context, k, nil)
+	if combined == nil {
+		return nil, nil, nil
+	}
+
+	var peak float64
+	for _, w := range combined {
+		peak = max(peak, w)
+	}
+	logits := make(map[byte]float64, len(combined))
+	if !(temp > 0) {
+		for ch, w := range combined {
+			if w == peak {
+				logits[ch] = 0
+			}
+		}
+	} else {
+		// Relative to the peak, so the largest logit is 0 and a small temp can't
+		// push the logits far enough apart to lose precision in the normalization
+		for ch, w := range combined {
+			logits[ch] = math.Log(w/peak) / temp
+		}
+	}
+
+	lse := logSumExp(logits)
+	for ch := range logits {
+		logits[ch] -= lse
+	}
+	return logits, nValues, matchCounts
+}
+
+// NextDistribution is NextLogDistribution in probability space: the next-byte
+// probabilities after context with temperature applied, summing to 1, plus the
+// per-level n values and match counts. A temp <= 0 spreads all mass evenly over the
+// highest-weighted bytes (greedy sampling takes the smallest of them). It returns nil
+// if no suffix of context matches.
+func NextDistribution(idx *suffixarray.Index, context string, temp float64, k int) (map[byte]float64, []int, []int) {
+	dist, nValues, matchCounts := NextLogDistribution(idx, context, temp, k)
+	for ch, lp := range dist {
+		dist[ch] = math.Exp(lp)
+	}
+	return dist, nValues, matchCounts
+}
+
+// logSumExp returns log(sum(exp(v))) over the values of m, shifting by the maximum
+// so that no term overflows or underflows.
+func logSumExp(m map[byte]float64) float64 {
+	peak := math.Inf(-1)
+	for _, v := range m {
+		peak = max(peak, v)
+	}
+	var sum float64
+	for _, v := range m {
+		sum += math.Exp(v - peak)
+	}
+	return peak + math.Log(sum)
+}
+
+// sampleWeighted applies temperature to the weights in dist (in place) and draws a byte
+// with probability proportional to the result. It reports false if dist is empty.
+// A temp of zero or less (or NaN) is greedy decoding: it returns the highest-weighted
+// byte, the smallest one on ties, without drawing.
+//
+// Raising weights to 1/temp and renormalizing is invariant to scaling the weights, so
+// this is exactly softmax(log(p)/temp) over the normalized probabilities p: raw counts
+// from a large corpus and a small one with the same proportions sample identically.
+//
+// Candidates are visited in ascending byte order, never in map order, so a given
+// uniform draw always maps to the same byte. Every sampler in the
+// package goes through here, which is what makes seeded generation reproducible.
+func sampleWeighted(dist map[byte]float64, temp float64, cfg *Config) (byte, bool) {
+	// Scale by the largest weight before applying temperature so that small temperatures
+	// can't overflow to +Inf
+	var peak float64
+	for _, w := range dist {
+		peak = max(peak, w)
+	}
+	if peak <= 0 {
+		// Nothing to draw from, which ends a run normally
+		return 0, false
+	}
+	if cfg != nil && cfg.Debug {
+		if err := checkDistribution(dist); err != nil {
+			panic(fmt.Sprintf("infini-gram: bad combined distribution: %v", err))
+		}
+	}
+
+	// Walk the candidates in ascending byte order rather than in map order, so a given
+	// draw always picks the same byte (and sums are taken in the same order), and u
+	// and 1-u land at opposite ends
+	chars := make([]byte, 0, len(dist))
+	for ch := range dist {
+		chars = append(chars, ch)
+	}
+	slices.Sort(chars)
+	if !(temp > 0) {
+		// 1/temp would be +Inf or flip the distribution; take the argmax instead,
+		// the smallest byte on ties
+		best := chars[0]
+		for _, ch := range chars[1:] {
+			if dist[ch] > dist[best] {
+				best = ch
+			}
+		}
+		return best, true
+	}
+	chars = cfg.truncate(chars, dist)
 
 	// Apply temperature and sample
 	var total float64
-	for ch, w := range combined {
-		combined[ch] = math.Pow(w, 1/temp)
-		total += combined[ch]
+	for _, ch := range chars {
+		dist[ch] = math.Pow(dist[ch]/peak, 1/temp)
+		total += dist[ch]
+	}
+	cfg.applyProbFloor(dist, total)
+	if cfg != nil && cfg.Debug {
+		if err := checkDistribution(dist); err != nil {
+			panic(fmt.Sprintf("infini-gram: bad sampling distribution at temp=%v: %v", temp, err))
+		}
+	}
+	r := cfg.float64() * total
+	for _, ch := range chars {
+		if r -= dist[ch]; r < 0 {
+			return ch, true
+		}
+	}
+	// Rounding can leave r just above zero after the last candidate
+	return chars[len(chars)-1], true
+}
+
+// checkDistribution reports an error unless every weight in dist is finite and
+// non-negative and the weights sum to a positive finite total.
+func checkDistribution(dist map[byte]float64) error {
+	var total float64
+	for ch, w := range dist {
+		if math.IsNaN(w) || math.IsInf(w, 0) || w < 0 {
+			return fmt.Errorf("weight %v for byte %q", w, ch)
+		}
+		total += w
+	}
+	if total <= 0 || math.IsInf(total, 0) {
+		return fmt.Errorf("weights sum to %v", total)
+	}
+	return nil
+}
+
+// keepOnly removes every byte not in allowed from dist.
+func keepOnly(dist map[byte]float64, allowed *[256]bool) {
+	for ch := range dist {
+		if !allowed[ch] {
+			delete(dist, ch)
+		}
+	}
+}
+
+// unigramDistribution returns the frequency of every byte in data.
+func unigramDistribution(data []byte) map[byte]float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
 	}
-	r := rand.Float64() * total
-	for ch, w := range combined {
-		if r -= w; r < 0 {
-			return ch, nValues, matchCounts
+	dist := make(map[byte]float64)
+	for b, c := range counts {
+		if c > 0 {
+			dist[byte(b)] = float64(c)
 		}
 	}
-	return 0, nil, nil
+	return dist
 }
 
-// LevelStats holds mean, std, and median for n and numMatches at a level.
+// inverseByteFrequency returns log(N/freq(b)) for every byte b of data, where N is
+// len(data), and 0 for bytes that don't occur.
+func inverseByteFrequency(data []byte) *[256]float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	var idf [256]float64
+	for b, c := range counts {
+		if c > 0 {
+			idf[b] = math.Log(float64(len(data)) / float64(c))
+		}
+	}
+	return &idf
+}
+
+// applyIDF scales each weight in dist by its byte's inverse frequency. A byte that
+// makes up the whole corpus has an IDF of zero; if that would zero out every weight,
+// dist is left as is.
+func applyIDF(dist map[byte]float64, idf *[256]float64) {
+	informative := false
+	for ch := range dist {
+		informative = informative || idf[ch] > 0
+	}
+	if !informative {
+		return
+	}
+	for ch, w := range dist {
+		dist[ch] = w * idf[ch]
+	}
+}
+
+// LevelStats holds mean, std, median, and percentiles for n and numMatches at a level.
 type LevelStats struct {
 	NMean, NStd, NMedian             float64
+	NP10, NP90                       int
 	MatchMean, MatchStd, MatchMedian float64
+	NHist                            []int // NHist[n] is how many steps this level used an n-gram of length n
 }
 
 // Generate produces text and returns stats for n and numMatches at each level.
+//
+// k is the number of n-gram levels to mix: at most k for k>0, all of them for k<0,
+// and an automatic choice for k=0 (see Config.MaxMatchThreshold; with the default
+// settings that is every level). Every k yields output as long as some suffix of the
+// context matches.
+//
+// temp == 0 decodes greedily, always taking the most likely next byte (the smallest
+// byte on ties), so the output is deterministic. Negative temperatures are treated as 0.
 func Generate(idx *suffixarray.Index, prompt string, maxChars int, temp float64, k int) (string, []LevelStats) {
+	return GenerateWithConfig(idx, prompt, maxChars, temp, k, nil)
+}
+
+// GenerateWithConfig is like Generate but takes optional settings. A nil cfg behaves like Generate.
+func GenerateWithConfig(idx *suffixarray.Index, prompt string, maxChars int, temp float64, k int, cfg *Config) (string, []LevelStats) {
+	return generate(idx, prompt, maxChars, temp, k, cfg, nil)
+}
+
+// Token is one generated byte and the length of the longest n-gram match that produced
+// it, or 0 if it was drawn from the unigram fallback (see Config.Strict).
+type Token struct {
+	Byte byte
+	N    int
+	// Contributions holds each level's share of Byte's combined probability before
+	// temperature: level i's weighted count of Byte over the total combined weight. They
+	// sum to Byte's combined probability, so a large first entry means the longest
+	// match drove the choice. It is nil for fallback draws.
+	Contributions []float64
+}
+
+// GenerateTokens is like GenerateWithConfig but returns each generated byte, excluding
+// the prompt, annotated with the n-gram length used to produce it.
+func GenerateTokens(idx *suffixarray.Index, prompt string, maxChars int, temp float64, k int, cfg *Config) []Token {
+	var tokens []Token
+	generate(idx, prompt, maxChars, temp, k, cfg, func(st genStep) bool {
+		tok := Token{Byte: st.ch, Contributions: st.contrib}
+		if len(st.ns) > 0 {
+			tok.N = st.ns[0]
+		}
+		tokens = append(tokens, tok)
+		return true
+	})
+	return tokens
+}
+
+// GenerateStream is like Generate but passes each generated byte to emit as soon as it
+// is sampled, excluding the prompt. If emit returns false generation stops after that
+// byte. The stats cover exactly the bytes passed to emit.
+func GenerateStream(idx *suffixarray.Index, prompt string, maxChars int, temp float64, k int, emit func(b byte) bool) []LevelStats {
+	return GenerateStreamWithConfig(idx, prompt, maxChars, temp, k, nil, emit)
+}
+
+// GenerateStreamWithConfig is like GenerateStream but takes optional settings. A nil
+// cfg behaves like GenerateStream.
+func GenerateStreamWithConfig(idx *suffixarray.Index, prompt string, maxChars int, temp float64, k int, cfg *Config, emit func(b byte) bool) []LevelStats {
+	_, stats := generate(idx, prompt, maxChars, temp, k, cfg, func(st genStep) bool {
+		return emit(st.ch)
+	})
+	return stats
+}
+
+// SampleInfinigram samples the byte after context the way the infini-gram paper
+// does, with no mixing of levels: it finds the longest suffix of context with at least
+// minCount continuations in the corpus and draws from that suffix's continuation
+// counts alone, with temperature. It returns the byte and the suffix length n, and
+// reports false if no suffix qualifies. cfg may be nil; its MinMatches is replaced by
+// minCount.
+func SampleInfinigram(idx *suffixarray.Index, context string, temp float64, minCount int, cfg *Config) (byte, int, bool) {
+	ch, ns, _ := SampleWithConfig(idx, context, temp, 1, backoffConfig(cfg, minCount))
+	if ns == nil {
+		return 0, 0, false
+	}
+	return ch, ns[0], true
+}
+
+// GenerateInfinigram generates like GenerateWithConfig but samples every byte as
+// SampleInfinigram does, and returns the suffix length n chosen at each generated
+// byte (0 for a Strict unigram fallback), showing how the effective order adapts.
+func GenerateInfinigram(idx *suffixarray.Index, prompt string, maxChars int, temp float64, minCount int, cfg *Config) (string, []int) {
+	var ns []int
+	text, _ := generate(idx, prompt, maxChars, temp, 1, backoffConfig(cfg, minCount), func(st genStep) bool {
+		n := 0
+		if len(st.ns) > 0 {
+			n = st.ns[0]
+		}
+		ns = append(ns, n)
+		return true
+	})
+	return text, ns
+}
+
+// backoffConfig returns a copy of cfg whose MinMatches is minCount.
+func backoffConfig(cfg *Config, minCount int) *Config {
+	var c Config
+	if cfg != nil {
+		c = *cfg
+	}
+	c.MinMatches = minCount
+	return &c
+}
+
+// GenerateBatch generates n independent continuations of prompt, as n calls to
+// GenerateWithConfig would, or in antithetic pairs under cfg.Antithetic.
+func GenerateBatch(idx *suffixarray.Index, prompt string, n, maxChars int, temp float64, k int, cfg *Config) []string {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	out := make([]string, n)
+	var draws []float64
+	for i := range out {
+		c := *cfg
+		switch {
+		case cfg.Antithetic && i%2 == 0:
+			draws = draws[:0]
+			c.uniform = func() float64 {
+				u := cfg.float64()
+				draws = append(draws, u)
+				return u
+			}
+		case cfg.Antithetic:
+			// Mirror the partner's draws; once its path ends, draw fresh ones
+			step := 0
+			c.uniform = func() float64 {
+				if step < len(draws) {
+					step++
+					return 1 - draws[step-1]
+				}
+				return cfg.float64()
+			}
+		}
+		out[i], _ = generate(idx, prompt, maxChars, temp, k, &c, nil)
+	}
+	return out
+}
+
+// genStep describes one emitted byte to generate's onStep hook.
+type genStep struct {
+	ch byte
+	// ns holds the n value of each level that produced ch, nil for a fallback draw
+	ns []int
+	// contrib is as in Token.Contributions
+	contrib []float64
+}
+
+// generate is the loop shared by the Generate variants. If onStep is non-nil it is
+// called after each emitted byte; returning false ends generation.
+func generate(idx *suffixarray.Index, prompt string, maxChars int, temp float64, k int, cfg *Config, onStep func(st genStep) bool) (string, []LevelStats) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	if cfg.LookupCacheSize > 0 {
+		withCache := *cfg
+		withCache.lookups = newLRUCache[[]int](cfg.LookupCacheSize)
+		cfg = &withCache
+	}
+	start := time.Now()
+	var text string
+	var stats []LevelStats
+	if cfg.Restarts > 1 && cfg.RestartInterval > 0 {
+		text, stats = generateWithRestarts(idx, prompt, maxChars, temp, k, cfg, onStep)
+	} else {
+		var levelNs, levelMatches [][]int
+		text, levelNs, levelMatches = generateRun(idx, prompt, maxChars, temp, k, cfg, 0, onStep)
+		stats = levelStats(levelNs, levelMatches)
+	}
+	if cfg.Logger != nil {
+		logGeneration(cfg.Logger, idx, prompt, text, maxChars, temp, k, cfg.contextWindow(), stats, time.Since(start))
+	}
+	return text, stats
+}
+
+// logGeneration records one generation's parameters and results on logger. A
+// contextLen of 0 means the context window was unbounded.
+func logGeneration(logger *slog.Logger, idx *suffixarray.Index, prompt, text string, maxChars int, temp float64, k, contextLen int, stats []LevelStats, elapsed time.Duration) {
+	attrs := []any{
+		slog.String("prompt", prompt),
+		slog.Int("max_chars", maxChars),
+		slog.Float64("temp", temp),
+		slog.Int("k", k),
+		slog.Int("context_len", contextLen),
+		slog.String("corpus", CorpusHash(idx.Bytes())),
+		slog.Int("generated", len(text)-len(prompt)),
+		slog.Duration("elapsed", elapsed),
+	}
+	if len(stats) > 0 {
+		attrs = append(attrs, slog.Float64("n_mean", stats[0].NMean), slog.Float64("n_median", stats[0].NMedian))
+	}
+	logger.Info("generate", attrs...)
+}
+
+// generateRun generates from prompt up to maxChars bytes and returns the text along
+// with the raw n values and match counts of each level, one entry per emitted byte.
+// generated is how many bytes were generated before prompt ended, for PrimeBias.
+func generateRun(idx *suffixarray.Index, prompt string, maxChars int, temp float64, k int, cfg *Config, generated int, onStep func(st genStep) bool) (string, [][]int, [][]int) {
 	result := []byte(prompt)
 	var levelNs [][]int
 	var levelMatches [][]int
+	var stepLevels []int // how many levels produced each generated byte
+	var unigram map[byte]float64
+	// scratch holds each step's distribution; sampling consumes it before the next step
+	scratch := cfg.scratch
+	if scratch == nil {
+		scratch = make(map[byte]float64)
+	}
+	var alphabet [256]bool
+	if cfg.CorpusAlphabetOnly {
+		alphabet, _ = corpusAlphabet(idx.Bytes())
+	}
+	var idf *[256]float64
+	if cfg.IDFWeighting {
+		idf = inverseByteFrequency(idx.Bytes())
+	}
+	// With a rune budget, runes counts the complete runes in result[len(prompt):decoded]
+	var runes int
+	decoded := len(prompt)
+	lines := 0
+	if cfg.MaxRunes > 0 {
+		maxChars = math.MaxInt
+	}
+	// longest is the longest matching suffix length when result was lookedUp bytes long
+	longest, lookedUp := len(result), len(result)
+	var enc utf8State
+	if cfg.ValidUTF8 {
+		enc = newUTF8State(result)
+	}
+	// When a stop sequence will be trimmed, onStep must never see its bytes, so steps
+	// that could start one are held back until they can't, or are trimmed
+	holdBack := onStep != nil && cfg.TrimStop && len(cfg.StopSequences) > 0
+	var held []genStep
+	stopped := false // onStep returned false
+	report := func(st genStep) bool {
+		if onStep == nil || stopped {
+			return !stopped
+		}
+		if !holdBack {
+			stopped = !onStep(st)
+			return !stopped
+		}
+		held = append(held, st)
+		release := len(held) - min(len(held), stopPrefixLen(result, cfg.StopSequences))
+		for _, st := range held[:release] {
+			if !onStep(st) {
+				stopped = true
+				break
+			}
+		}
+		held = held[release:]
+		return !stopped
+	}
 
-	for len(result) < maxChars {
-		start := max(0, len(result)-200)
-		ch, ns, matches := Sample(idx, string(result[start:]), temp, k)
-		if ch == 0 {
-			break
+	// emit appends ch, produced by levels with the given n values, match counts and
+	// contributions, and reports whether generation should continue
+	emit := func(ch byte, ns, matches []int, contrib []float64) bool {
+		if cfg.EOS && cfg.StopAtEOS && ch == cfg.EOSByte {
+			return false
 		}
 		result = append(result, ch)
+		if cfg.ValidUTF8 {
+			enc.push(ch)
+		}
+		if cfg.OutputCounts != nil {
+			cfg.OutputCounts[ch]++
+		}
 		for i, n := range ns {
 			for len(levelNs) <= i {
 				levelNs = append(levelNs, nil)
@@ -117,116 +698,298 @@ func Generate(idx *suffixarray.Index, prompt string, maxChars int, temp float64,
 			}
 			levelMatches[i] = append(levelMatches[i], m)
 		}
+		stepLevels = append(stepLevels, len(ns))
+		if !report(genStep{ch, ns, contrib}) {
+			return false
+		}
+		for _, stop := range cfg.StopSequences {
+			if stop != "" && bytes.HasSuffix(result, []byte(stop)) {
+				if cfg.TrimStop {
+					// Trimmed bytes leave no trace: not in the text, the stats, OutputCounts or onStep
+					trimmed := min(len(stop), len(result)-len(prompt))
+					if cfg.OutputCounts != nil {
+						for _, b := range result[len(result)-trimmed:] {
+							cfg.OutputCounts[b]--
+						}
+					}
+					result = result[:len(result)-trimmed]
+					held = held[:max(0, len(held)-trimmed)]
+					for _, levels := range stepLevels[len(stepLevels)-trimmed:] {
+						for i := range levels {
+							levelNs[i] = levelNs[i][:len(levelNs[i])-1]
+							levelMatches[i] = levelMatches[i][:len(levelMatches[i])-1]
+						}
+					}
+					if cfg.ValidUTF8 {
+						enc = newUTF8State(result)
+					}
+				}
+				return false
+			}
+		}
+		if ch == '\n' && cfg.MaxLines > 0 {
+			if lines++; lines >= cfg.MaxLines {
+				return false
+			}
+		}
+		if cfg.MaxRunes > 0 {
+			// A byte that breaks off an unfinished sequence completes several runes
+			for utf8.FullRune(result[decoded:]) {
+				_, size := utf8.DecodeRune(result[decoded:])
+				decoded += size
+				runes++
+			}
+			return runes < cfg.MaxRunes
+		}
+		return true
 	}
 
-	stats := make([]LevelStats, max(len(levelNs), len(levelMatches)))
-	for i := range stats {
-		if i < len(levelNs) && len(levelNs[i]) > 0 {
-			stats[i].NMean, stats[i].NStd, stats[i].NMedian = meanStdMedian(levelNs[i])
+	for len(result) < maxChars || enc.need > 0 {
+		start := len(result) - len(cfg.context(result))
+		if cfg.ValidUTF8 {
+			start = runeStart(result, start)
 		}
-		if i < len(levelMatches) && len(levelMatches[i]) > 0 {
-			stats[i].MatchMean, stats[i].MatchStd, stats[i].MatchMedian = meanStdMedian(levelMatches[i])
+		context := cfg.document(string(result[start:]))
+		// The longest match can grow by at most one byte per byte emitted since the
+		// last lookup, so only that bound and shorter suffixes need probing
+		longest = longestSuffixMatchBelow(idx, context, min(len(context), longest+len(result)-lookedUp))
+		lookedUp = len(result)
+		run, count := cfg.phraseRun(idx, context, longest)
+		if cfg.ValidUTF8 {
+			run = enc.validPrefix(run)
+		}
+		if len(run) > 1 && longest >= cfg.MinAcceptableN {
+			// Deterministic region: copy the whole agreed continuation at once
+			stop := false
+			for j, ch := range run[:min(len(run), max(maxChars-len(result), enc.need))] {
+				if !emit(ch, []int{longest + j}, []int{count}, []float64{1}) {
+					stop = true
+					break
+				}
+			}
+			if stop {
+				break
+			}
+			continue
 		}
-	}
-	return string(result), stats
-}
 
-func meanStdMedian(vals []int) (float64, float64, float64) {
-	if len(vals) == 0 {
-		return 0, 0, 0
-	}
-	var sum int
-	for _, v := range vals {
-		sum += v
+		levels := findLevelsFrom(idx, context, longest, k, cfg, -1)
+		if len(levels) > 0 && levels[0].n < cfg.MinAcceptableN {
+			// Too little context matched to trust; handle it like no match at all
+			levels = nil
+		}
+		dist, ns, matches := combineLevelsInto(scratch, levels, cfg)
+		var total float64
+		if onStep != nil {
+			// Sampling reweights dist in place, so take the total first
+			for _, w := range dist {
+				total += w
+			}
+		}
+		if dist == nil && len(cfg.Allowed) > 0 {
+			// Not even a single byte has an allowed continuation
+			dist = scratch
+			clear(dist)
+			for _, ch := range cfg.Allowed {
+				dist[ch] = 1
+			}
+		}
+		if dist == nil {
+			if !cfg.Strict {
+				break
+			}
+			// No suffix matched: fall back to the unigram distribution
+			if unigram == nil {
+				unigram = unigramDistribution(idx.Bytes())
+			}
+			dist = scratch
+			clear(dist)
+			maps.Copy(dist, unigram)
+		}
+		cfg.applyPrimeBias(dist, generated+len(result)-len(prompt))
+		cfg.applyRepetitionPenalty(dist, result)
+		if idf != nil {
+			applyIDF(dist, idf)
+		}
+		if cfg.CorpusAlphabetOnly {
+			keepOnly(dist, &alphabet)
+		}
+		if cfg.ValidUTF8 {
+			keepOnly(dist, enc.allowed())
+		}
+		ch, ok := sampleWeighted(dist, temp, cfg)
+		if !ok {
+			break
+		}
+		var contrib []float64
+		if onStep != nil && ns != nil {
+			contrib = levelContributions(levels, ch, total, cfg)
+		}
+		if !emit(ch, ns, matches, contrib) {
+			break
+		}
 	}
-	mean := float64(sum) / float64(len(vals))
-	var varSum float64
-	for _, v := range vals {
-		varSum += (float64(v) - mean) * (float64(v) - mean)
+	if enc.need > 0 {
+		// Dead end in the middle of a character: drop it
+		i := len(result) - 1
+		for i > 0 && !utf8.RuneStart(result[i]) {
+			i--
+		}
+		result = result[:i]
 	}
-	sorted := make([]int, len(vals))
-	copy(sorted, vals)
-	sort.Ints(sorted)
-	var median float64
-	if len(sorted)%2 == 0 {
-		median = float64(sorted[len(sorted)/2-1]+sorted[len(sorted)/2]) / 2
-	} else {
-		median = float64(sorted[len(sorted)/2])
+	for _, st := range held {
+		if stopped || !onStep(st) {
+			break
+		}
 	}
-	return mean, math.Sqrt(varSum / float64(len(vals))), median
+	return string(result), levelNs, levelMatches
 }
 
-// Perplexity computes perplexity on the given text.
-func Perplexity(idx *suffixarray.Index, text string, k int, contextLen int) float64 {
-	var logProbSum float64
-	var count int
-
-	for i := 1; i < len(text); i++ {
-		start := max(0, i-contextLen)
-		context := text[start:i]
-
-		dist, _, _ := buildDistribution(idx, context, k)
-		if dist == nil {
-			logProbSum += math.Log(1e-10)
-			count++
-			continue
+// stopPrefixLen returns the length of the longest suffix of text that is a prefix of
+// one of stops, or all of it.
+func stopPrefixLen(text []byte, stops []string) int {
+	longest := 0
+	for _, stop := range stops {
+		for n := min(len(stop), len(text)); n > longest; n-- {
+			if bytes.HasSuffix(text, []byte(stop[:n])) {
+				longest = n
+				break
+			}
 		}
+	}
+	return longest
+}
 
-		// Normalize to probabilities
-		var total float64
-		for _, w := range dist {
-			total += w
+// generateWithRestarts generates in segments of cfg.RestartInterval bytes. Each segment
+// is drawn cfg.Restarts times from the text so far and the least repetitive candidate
+// is kept, so loops that one draw would fall into are usually avoided.
+func generateWithRestarts(idx *suffixarray.Index, prompt string, maxChars int, temp float64, k int, cfg *Config, onStep func(st genStep) bool) (string, []LevelStats) {
+	// Candidates must not be tallied; only the kept segment counts
+	segCfg := *cfg
+	segCfg.Restarts = 0
+	segCfg.OutputCounts = nil
+	segCfg.MaxRunes = 0
+	segCfg.MaxLines = 0
+	segCfg.StopSequences = nil
+
+	text := prompt
+	var levelNs, levelMatches [][]int
+	for len(text) < maxChars {
+		end := min(len(text)+cfg.RestartInterval, maxChars)
+		var best string
+		var bestNs, bestMatches [][]int
+		var bestSteps []genStep
+		bestScore := -1.0
+		for r := 0; r < cfg.Restarts; r++ {
+			var steps []genStep
+			cand, ns, matches := generateRun(idx, text, end, temp, k, &segCfg, len(text)-len(prompt), func(st genStep) bool {
+				steps = append(steps, st)
+				return true
+			})
+			if score := restartScore(cand, len(text), end); score > bestScore {
+				best, bestNs, bestMatches, bestSteps, bestScore = cand, ns, matches, steps, score
+			}
 		}
-		for ch := range dist {
-			dist[ch] /= total
+		if len(best) == len(text) {
+			// Every candidate hit a dead end
+			break
 		}
 
-		p := dist[text[i]]
-		if p > 0 {
-			logProbSum += math.Log(p)
-		} else {
-			// Smoothing for unseen characters
-			logProbSum += math.Log(1e-10)
+		for i, st := range bestSteps {
+			if cfg.OutputCounts != nil {
+				cfg.OutputCounts[st.ch]++
+			}
+			if onStep != nil && !onStep(st) {
+				best = best[:len(text)+i+1]
+				// A level has an n value and a match count for exactly the bytes it
+				// produced, so count those among the kept bytes
+				var kept []int
+				for _, st := range bestSteps[:i+1] {
+					for lvl := range st.ns {
+						for len(kept) <= lvl {
+							kept = append(kept, 0)
+						}
+						kept[lvl]++
+					}
+				}
+				bestNs, bestMatches = truncateLevels(bestNs, kept), truncateLevels(bestMatches, kept)
+				end = 0
+				break
+			}
+		}
+		text = best
+		levelNs, levelMatches = appendLevels(levelNs, bestNs), appendLevels(levelMatches, bestMatches)
+		if end == 0 {
+			break
 		}
-		count++
 	}
-	return math.Exp(-logProbSum / float64(count))
+	return text, levelStats(levelNs, levelMatches)
 }
 
-func measurePerplexity(idx *suffixarray.Index, trainData, valData []byte, k int) {
-	// Compute perplexity on validation set with k=-1 (all levels)
-	fmt.Printf("\nComputing perplexity on %d val chars...\n", len(valData))
-	start := time.Now()
-	ppl := Perplexity(idx, string(valData), k, 100)
-	fmt.Printf("Validation Perplexity (k=%d): %.2f (took %.2fs)\n", k, ppl, time.Since(start).Seconds())
-
-	// Compute perplexity on train set with k=-1 (all levels)
-	fmt.Printf("\nComputing perplexity on %d train chars...\n", len(trainData))
-	start = time.Now()
-	ppl = Perplexity(idx, string(trainData), k, 100)
-	fmt.Printf("Train Perplexity (k=%d): %.2f (took %.2fs)\n", k, ppl, time.Since(start).Seconds())
+// levelContributions splits ch's combined probability by level, as described for
+// Token.Contributions. total is the sum of the combined distribution's weights.
+func levelContributions(levels []level, ch byte, total float64, cfg *Config) []float64 {
+	if total <= 0 {
+		return nil
+	}
+	contrib := make([]float64, len(levels))
+	weights := cfg.levelWeights(levels)
+	for i, lvl := range levels {
+		// Alpha is added at every level for bytes seen anywhere, which includes ch
+		contrib[i] = weights[i] * (lvl.counts[ch] + cfg.alpha()) / total
+	}
+	return contrib
 }
 
-func main() {
-	data, _ := os.ReadFile("data.txt")
+// restartScore rates a candidate for text[from:end], whose new bytes start at
+// text[from:], by the number of distinct 4-grams in the new bytes plus the preceding
+// window of the same length, over the number a full-length candidate could have there.
+// A segment that repeats itself or what came just before it scores lower, and so does
+// one that hit a dead end before end, which has fewer 4-grams to offer.
+func restartScore(text string, from, end int) float64 {
+	start := max(0, from-(end-from))
+	seen := make(map[string]struct{})
+	for i := start; i+4 <= len(text); i++ {
+		seen[text[i:i+4]] = struct{}{}
+	}
+	return float64(len(seen)) / float64(max(1, end-start-3))
+}
 
-	n := int(float64(len(data)) * 0.9)
-	trainData := data[:n]
-	// valData := data[n:]
+// appendLevels appends the per-level values in src to those in dst, level by level.
+func appendLevels(dst, src [][]int) [][]int {
+	for i, vals := range src {
+		for len(dst) <= i {
+			dst = append(dst, nil)
+		}
+		dst[i] = append(dst[i], vals...)
+	}
+	return dst
+}
 
-	idx := suffixarray.New(trainData)
-	k := 3
+// truncateLevels keeps the first kept[i] values of each level i, dropping levels
+// beyond len(kept).
+func truncateLevels(levels [][]int, kept []int) [][]int {
+	levels = levels[:min(len(levels), len(kept))]
+	for i := range levels {
+		levels[i] = levels[i][:kept[i]]
+	}
+	return levels
+}
 
-	start := time.Now()
-	output, stats := Generate(idx, "First Citizen:", 1000, 0.8, k)
-	fmt.Println(output)
-	fmt.Printf("\nGenerated %d chars in %.4fs\n", len(output), time.Since(start).Seconds())
-	for i, s := range stats {
-		if s.NMean > 0 {
-			fmt.Printf("  Level %d: n(med=%.1f, avg=%.2f, std=%.2f) m(med=%.1f, avg=%.1f, std=%.1f)\n",
-				i+1, s.NMedian, s.NMean, s.NStd, s.MatchMedian, s.MatchMean, s.MatchStd)
+// levelStats summarizes the n values and match counts collected for each level.
+func levelStats(levelNs, levelMatches [][]int) []LevelStats {
+	stats := make([]LevelStats, max(len(levelNs), len(levelMatches)))
+	for i := range stats {
+		if i < len(levelNs) && len(levelNs[i]) > 0 {
+			ns := Stats(levelNs[i])
+			stats[i].NMean, stats[i].NStd, stats[i].NMedian = ns.Mean, ns.Std, ns.Median
+			stats[i].NP10, stats[i].NP90 = ns.P10, ns.P90
+			stats[i].NHist = histogram(levelNs[i])
+		}
+		if i < len(levelMatches) && len(levelMatches[i]) > 0 {
+			ms := Stats(levelMatches[i])
+			stats[i].MatchMean, stats[i].MatchStd, stats[i].MatchMedian = ms.Mean, ms.Std, ms.Median
 		}
 	}
-
-	// measurePerplexity(idx, trainData, valData, k)
+	return stats
 }
@@ -0,0 +1,894 @@
+package infinigram
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"index/suffixarray"
+	"log/slog"
+	"maps"
+	"math"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+)
+
+// testCorpus is a small corpus with enough repetition for multi-level matches.
+const testCorpus = "the cat sat on the mat. the cat ate the rat. the dog sat on the log. " +
+	"a cat and a dog sat on a mat. the rat ran from the cat. the dog ran after the cat."
+
+// newTestIndex builds an index over corpus.
+func newTestIndex(t testing.TB, corpus string) *suffixarray.Index {
+	t.Helper()
+	return suffixarray.New([]byte(corpus))
+}
+
+func TestStrictProducesMaxChars(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	// Nothing in the corpus follows "zq", so without Strict generation stops at once
+	if text, _ := GenerateWithConfig(idx, "zq", 100, 0.8, 3, &Config{Rand: rand.New(rand.NewSource(1))}); text != "zq" {
+		t.Fatalf("non-strict generation from a dead end = %q, want the prompt", text)
+	}
+	for seed := range int64(5) {
+		text, _ := GenerateWithConfig(idx, "zq", 100, 0.8, 3, &Config{Strict: true, Rand: rand.New(rand.NewSource(seed))})
+		if len(text) != 100 {
+			t.Errorf("seed %d: strict generation gave %d bytes, want 100", seed, len(text))
+		}
+	}
+}
+
+// TestConcurrentGenerate is meant to run under -race: goroutines share an index but
+// each draws from its own Rand, so they neither race nor affect each other's output.
+func TestConcurrentGenerate(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	const n = 8
+	want := make([]string, n)
+	for i := range want {
+		want[i], _ = GenerateWithConfig(idx, "the ", 300, 0.8, 3, &Config{Rand: rand.New(rand.NewSource(int64(i)))})
+	}
+
+	got := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range got {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got[i], _ = GenerateWithConfig(idx, "the ", 300, 0.8, 3, &Config{Rand: rand.New(rand.NewSource(int64(i)))})
+		}()
+	}
+	wg.Wait()
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("seed %d: concurrent generation %q, sequential %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestOutputCounts(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	for _, cfg := range []*Config{
+		{},
+		{Strict: true},
+		{Restarts: 3, RestartInterval: 16},
+	} {
+		cfg.Rand = rand.New(rand.NewSource(1))
+		cfg.OutputCounts = make(map[byte]int)
+		text, _ := GenerateWithConfig(idx, "the ", 200, 0.8, 3, cfg)
+
+		want := make(map[byte]int)
+		for _, b := range []byte(text[len("the "):]) {
+			want[b]++
+		}
+		if !maps.Equal(cfg.OutputCounts, want) {
+			t.Errorf("Restarts=%d: OutputCounts %v, want the tally of %q", cfg.Restarts, cfg.OutputCounts, text)
+		}
+	}
+}
+
+// fuzzSeeds are the edge cases the fuzz targets start from: empty and one-byte corpora,
+// a run of one byte, NUL bytes, invalid UTF-8, and an empty context.
+var fuzzSeeds = []struct {
+	corpus, context string
+}{
+	{"", ""},
+	{"", "abc"},
+	{"a", ""},
+	{"a", "a"},
+	{"aaaaaaaa", "aaa"},
+	{"a\x00b\x00a\x00", "\x00"},
+	{"\x00\x00\x00", "\x00\x00"},
+	{"ab\xffcd\xfe\xff", "\xff"},
+	{"\xe4\xb8\xad\xe6\x96\x87\xe4\xb8", "\xe4"},
+	{testCorpus, "the c"},
+}
+
+func FuzzBuildDistribution(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		for _, k := range []int{-1, 0, 1, 3} {
+			f.Add([]byte(s.corpus), s.context, k)
+		}
+	}
+	f.Fuzz(func(t *testing.T, corpus []byte, context string, k int) {
+		idx := suffixarray.New(corpus)
+		dist, nValues, matchCounts := BuildDistribution(idx, context, k, nil)
+		if len(nValues) != len(matchCounts) {
+			t.Fatalf("%d n values but %d match counts", len(nValues), len(matchCounts))
+		}
+		for ch, w := range dist {
+			if math.IsNaN(w) || math.IsInf(w, 0) || w < 0 {
+				t.Fatalf("weight %v for byte %q", w, ch)
+			}
+		}
+		if dist != nil {
+			if err := checkDistribution(dist); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+func FuzzSample(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		for _, temp := range []float64{0, 1e-9, 0.8, 100} {
+			f.Add([]byte(s.corpus), s.context, temp, 3, int64(1))
+		}
+	}
+	f.Fuzz(func(t *testing.T, corpus []byte, context string, temp float64, k int, seed int64) {
+		idx := suffixarray.New(corpus)
+
+		probs, _, _ := NextDistribution(idx, context, temp, k)
+		var total float64
+		for ch, p := range probs {
+			if math.IsNaN(p) || p < 0 || p > 1 {
+				t.Fatalf("NextDistribution: probability %v for byte %q at temp=%v", p, ch, temp)
+			}
+			total += p
+		}
+		if probs != nil && math.Abs(total-1) > 1e-9 {
+			t.Fatalf("NextDistribution: probabilities sum to %v at temp=%v", total, temp)
+		}
+
+		ch, nValues, _ := SampleWithRand(idx, context, temp, k, rand.New(rand.NewSource(seed)))
+		dist, _, _ := BuildDistribution(idx, context, k, nil)
+		if nValues == nil {
+			if dist != nil {
+				t.Fatalf("Sample found nothing to draw from %v", dist)
+			}
+			return
+		}
+		if dist[ch] <= 0 {
+			t.Fatalf("Sample drew %q, which has weight %v", ch, dist[ch])
+		}
+	})
+}
+
+func TestStartN(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	context := "the dog ran after the cat. the cat sat on the mat. the "
+	for _, startN := range []int{1, 5, 12} {
+		_, ns, _ := BuildDistribution(idx, context, 0, &Config{StartN: startN})
+		if len(ns) == 0 {
+			t.Fatalf("StartN=%d: no levels", startN)
+		}
+		for _, n := range ns {
+			if n > startN {
+				t.Errorf("StartN=%d: level with n=%d", startN, n)
+			}
+		}
+	}
+	if _, ns, _ := BuildDistribution(idx, context, 0, nil); ns[0] <= 12 {
+		t.Errorf("without StartN the longest level is %d, want more than 12", ns[0])
+	}
+}
+
+func BenchmarkStartN(b *testing.B) {
+	corpus := strings.Repeat(testCorpus+" ", 500)
+	idx := newTestIndex(b, corpus)
+	// A long context whose full-length suffixes never occur
+	context := strings.Repeat("the cat sat on the log. ", 8) + "the "
+	for _, startN := range []int{0, 16} {
+		b.Run(fmt.Sprintf("StartN=%d", startN), func(b *testing.B) {
+			cfg := &Config{StartN: startN}
+			for range b.N {
+				BuildDistribution(idx, context, 3, cfg)
+			}
+		})
+	}
+}
+
+func TestDebugAllowsEmptyDistribution(t *testing.T) {
+	cfg := &Config{Debug: true}
+	if _, ok := sampleWeighted(map[byte]float64{}, 0.8, cfg); ok {
+		t.Error("sampleWeighted drew from an empty distribution")
+	}
+	idx := newTestIndex(t, testCorpus)
+	if got := GenerateMixture([]*suffixarray.Index{idx}, []float64{1}, "zq", 20, 0.8, 3, cfg); got != "zq" {
+		t.Errorf("GenerateMixture with no match = %q, want the prompt", got)
+	}
+	rev := NewReverseModel([]byte(testCorpus))
+	if _, ok := InfillBetween(idx, rev, "zq", "qz", 20, 0.8, 3, cfg); ok {
+		t.Error("InfillBetween with no match reported success")
+	}
+
+	// ValidUTF8 rules out every continuation of "a": each is an invalid byte
+	utf8Idx := newTestIndex(t, "ab\xffab\xff")
+	text, _ := GenerateWithConfig(utf8Idx, "a", 10, 0.8, 3, &Config{Debug: true, ValidUTF8: true})
+	if text != "ab" {
+		t.Errorf("GenerateWithConfig = %q, want %q", text, "ab")
+	}
+}
+
+func TestDebugCatchesCorruptDistribution(t *testing.T) {
+	for _, dist := range []map[byte]float64{
+		{'a': 1, 'b': math.NaN()},
+		{'a': 1, 'b': math.Inf(1)},
+		{'a': 1, 'b': -0.5},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("sampleWeighted(%v) with Debug didn't panic", dist)
+				}
+			}()
+			sampleWeighted(dist, 0.8, &Config{Debug: true})
+		}()
+	}
+}
+
+func TestCorpusAlphabetOnly(t *testing.T) {
+	corpus := "\x00\x01\x02\xff\x00\x01\x03\xfe\x00\x02\x01\xff"
+	idx := newTestIndex(t, corpus)
+	alphabet, _ := corpusAlphabet([]byte(corpus))
+	for seed := range int64(20) {
+		cfg := &Config{CorpusAlphabetOnly: true, Rand: rand.New(rand.NewSource(seed))}
+		text, _ := GenerateWithConfig(idx, "\x00", 100, 2, -1, cfg)
+		for _, b := range []byte(text) {
+			if !alphabet[b] {
+				t.Fatalf("seed %d: emitted %q, which isn't in the corpus", seed, b)
+			}
+		}
+	}
+
+	// The filter itself drops a byte the corpus lacks
+	dist := map[byte]float64{0x00: 1, 0x01: 2, 'z': 3}
+	keepOnly(dist, &alphabet)
+	if _, ok := dist['z']; ok || len(dist) != 2 {
+		t.Errorf("after keepOnly, dist = %v, want only corpus bytes", dist)
+	}
+}
+
+func TestGenerateTokens(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	prompt := "the cat "
+	text, _ := GenerateWithConfig(idx, prompt, 300, 0.8, 3, &Config{Rand: rand.New(rand.NewSource(1))})
+	tokens := GenerateTokens(idx, prompt, 300, 0.8, 3, &Config{Rand: rand.New(rand.NewSource(1))})
+	if len(tokens) != len(text)-len(prompt) {
+		t.Fatalf("%d tokens for %d generated bytes", len(tokens), len(text)-len(prompt))
+	}
+	for i, tok := range tokens {
+		pos := len(prompt) + i
+		if tok.Byte != text[pos] {
+			t.Errorf("token %d is %q, generated byte is %q", i, tok.Byte, text[pos])
+		}
+		// n is the longest matching suffix of the context window before the byte
+		context := text[max(0, pos-defaultContextWindow):pos]
+		if want := LongestSuffixMatch(idx, context); tok.N < 1 || tok.N != want {
+			t.Errorf("token %d has n=%d, want the longest match %d", i, tok.N, want)
+		}
+	}
+}
+
+func TestNextLogDistribution(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	for _, context := range []string{"the ", "the cat ", "a dog sat on "} {
+		weights, _, _ := BuildDistribution(idx, context, 3, nil)
+		for _, temp := range []float64{0.3, 1, 2.5} {
+			logs, _, _ := NextLogDistribution(idx, context, temp, 3)
+			probs, _, _ := NextDistribution(idx, context, temp, 3)
+			// The linear distribution is the weights raised to 1/temp, normalized
+			var total float64
+			for _, w := range weights {
+				total += math.Pow(w, 1/temp)
+			}
+			if len(logs) != len(weights) || len(probs) != len(weights) {
+				t.Fatalf("%q at temp=%v: %d log-probabilities and %d probabilities for %d bytes", context, temp, len(logs), len(probs), len(weights))
+			}
+			for ch, w := range weights {
+				want := math.Pow(w, 1/temp) / total
+				if got := math.Exp(logs[ch]); math.Abs(got-want) > 1e-9*want {
+					t.Errorf("%q at temp=%v: exp(log p(%q)) = %v, want %v", context, temp, ch, got, want)
+				}
+				if got := probs[ch]; math.Abs(got-want) > 1e-9*want {
+					t.Errorf("%q at temp=%v: p(%q) = %v, want %v", context, temp, ch, got, want)
+				}
+			}
+		}
+	}
+
+	// Probabilities too small for a float64 still get finite log-probabilities
+	logs, _, _ := NextLogDistribution(idx, "the ", 0.001, 3)
+	underflowed := false
+	for ch, lp := range logs {
+		if math.IsNaN(lp) || math.IsInf(lp, 0) {
+			t.Errorf("at temp=0.001, log p(%q) = %v", ch, lp)
+		}
+		underflowed = underflowed || math.Exp(lp) == 0
+	}
+	if !underflowed {
+		t.Error("at temp=0.001, no probability underflows; the check is vacuous")
+	}
+}
+
+func TestAutoK(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	context := "the dog sat on the "
+	_, allNs, allMatches := BuildDistribution(idx, context, -1, nil)
+	if len(allNs) < 3 {
+		t.Fatalf("only %d levels; the corpus is too small for this test", len(allNs))
+	}
+
+	// Levels stop before the first with more than the threshold of matches
+	threshold := allMatches[1]
+	_, ns, matches := BuildDistribution(idx, context, 0, &Config{MaxMatchThreshold: threshold})
+	if want := allNs[:2]; !slices.Equal(ns, want) {
+		t.Errorf("auto levels n=%v (matches %v), want %v of %v", ns, matches, want, allNs)
+	}
+	for _, m := range matches {
+		if m > threshold {
+			t.Errorf("auto mode used a level with %d matches, above the threshold %d", m, threshold)
+		}
+	}
+
+	// The longest level is kept however generic it is
+	if _, ns, _ := BuildDistribution(idx, context, 0, &Config{MaxMatchThreshold: 1}); !slices.Equal(ns, allNs[:1]) {
+		t.Errorf("with threshold 1, levels n=%v, want only the longest %v", ns, allNs[:1])
+	}
+	// With no threshold, auto uses every level
+	if _, ns, _ := BuildDistribution(idx, context, 0, nil); !slices.Equal(ns, allNs) {
+		t.Errorf("without a threshold, levels n=%v, want all of %v", ns, allNs)
+	}
+}
+
+func TestRestartScorePrefersFullLength(t *testing.T) {
+	text := "so it was "
+	full := text + "the cat and the cats" // 20 new bytes, some 4-grams repeated
+	short := text + "quick"               // a dead end after 5 distinct bytes
+	end := len(full)
+	if fs, ss := restartScore(full, len(text), end), restartScore(short, len(text), end); fs <= ss {
+		t.Errorf("full-length candidate scored %v, dead end %v", fs, ss)
+	}
+	loop := text + "abababababababababab"
+	if fs, ls := restartScore(full, len(text), end), restartScore(loop, len(text), end); fs <= ls {
+		t.Errorf("varied candidate scored %v, loop %v", fs, ls)
+	}
+}
+
+func TestRestartsReduceRepetition(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	// localDistinct is the mean distinct-4 ratio of each 100-byte block, the
+	// repetition restarts are meant to break up
+	localDistinct := func(text string) float64 {
+		var sum float64
+		for i := 0; i+100 <= len(text); i += 100 {
+			sum += DistinctN(text[i:i+100], 4)
+		}
+		return sum / float64(len(text)/100)
+	}
+	var plain, restarted float64
+	for seed := range int64(20) {
+		// At low temperature this corpus soon loops through "the cat"
+		text, _ := GenerateWithConfig(idx, "the cat", 300, 0.3, 3, &Config{Rand: rand.New(rand.NewSource(seed))})
+		plain += localDistinct(text)
+		text, _ = GenerateWithConfig(idx, "the cat", 300, 0.3, 3, &Config{Rand: rand.New(rand.NewSource(seed)), Restarts: 8, RestartInterval: 50})
+		if len(text) != 300 {
+			t.Errorf("seed %d: %d bytes with restarts, want 300", seed, len(text))
+		}
+		restarted += localDistinct(text)
+	}
+	if restarted <= plain {
+		t.Errorf("mean local distinct-4 %v with restarts, %v without", restarted/20, plain/20)
+	}
+}
+
+func TestMaxOffsetsApproximatesDistribution(t *testing.T) {
+	// "a" is followed by b 700 times and by c 300 times
+	var corpus strings.Builder
+	for i := range 1000 {
+		if i%10 < 7 {
+			corpus.WriteString("ab ")
+		} else {
+			corpus.WriteString("ac ")
+		}
+	}
+	idx := newTestIndex(t, corpus.String())
+	full, _, _ := BuildDistribution(idx, "a", 1, nil)
+
+	cfg := &Config{MaxOffsets: 50, Rand: rand.New(rand.NewSource(1))}
+	const draws = 200
+	var meanB float64
+	for range draws {
+		dist, _, matches := BuildDistribution(idx, "a", 1, cfg)
+		if matches[0] != 1000 {
+			t.Fatalf("match count %d, want the full 1000", matches[0])
+		}
+		// Scaling keeps the total weight that of the full distribution
+		if total := dist['b'] + dist['c']; math.Abs(total-1000) > 1e-9 {
+			t.Fatalf("sampled weights sum to %v, want 1000", total)
+		}
+		meanB += dist['b'] / draws
+	}
+	// Each sample's share of b has a standard deviation of about 0.065, so the mean
+	// over 200 samples should be well within 0.02 of the full 0.7
+	if got, want := meanB/1000, full['b']/(full['b']+full['c']); math.Abs(got-want) > 0.02 {
+		t.Errorf("mean sampled share of b = %v, want about %v", got, want)
+	}
+}
+
+func TestTemperatureIgnoresScale(t *testing.T) {
+	// Temperature on raw counts and on normalized probabilities are the same thing:
+	// scaling every weight leaves each draw unchanged
+	draw := func(scale float64) []byte {
+		cfg := &Config{Rand: rand.New(rand.NewSource(1))}
+		var out []byte
+		for range 500 {
+			ch, _ := sampleWeighted(map[byte]float64{'a': 3 * scale, 'b': 1 * scale, 'c': 0.5 * scale}, 0.5, cfg)
+			out = append(out, ch)
+		}
+		return out
+	}
+	counts := draw(1)
+	normalized := draw(1 / 4.5)
+	for _, scale := range []float64{1 / 4.5, 1e-6, 1e6} {
+		if got := draw(scale); !slices.Equal(got, counts) {
+			t.Errorf("weights scaled by %v drew differently", scale)
+		}
+	}
+
+	// And both match softmax(log(p)/T) over the normalized probabilities
+	var a int
+	for _, ch := range normalized {
+		if ch == 'a' {
+			a++
+		}
+	}
+	want := 9 / (9 + 1 + 0.25) // p^(1/0.5), normalized
+	if got := float64(a) / 500; math.Abs(got-want) > 0.05 {
+		t.Errorf("drew a %v of the time, want about %v", got, want)
+	}
+}
+
+func TestIDFWeighting(t *testing.T) {
+	// After "x", the common byte a is three times as likely as the rare q
+	corpus := "xa xa xa xq " + strings.Repeat("a", 20)
+	idx := newTestIndex(t, corpus)
+	idf := inverseByteFrequency([]byte(corpus))
+	if !(idf['a'] < idf[' '] && idf[' '] < idf['q']) {
+		t.Errorf("IDF a=%v space=%v q=%v, want increasing with rarity", idf['a'], idf[' '], idf['q'])
+	}
+
+	dist := map[byte]float64{'a': 3, 'q': 1}
+	applyIDF(dist, idf)
+	if dist['q'] <= dist['a'] {
+		t.Errorf("after IDF, weights a=%v q=%v; want the rare byte ahead", dist['a'], dist['q'])
+	}
+	if text, _ := GenerateWithConfig(idx, "x", 2, 0, 1, nil); text != "xa" {
+		t.Errorf("greedy without IDF = %q, want %q", text, "xa")
+	}
+	if text, _ := GenerateWithConfig(idx, "x", 2, 0, 1, &Config{IDFWeighting: true}); text != "xq" {
+		t.Errorf("greedy with IDF = %q, want %q", text, "xq")
+	}
+
+	// A byte making up the whole corpus has no IDF, so weights are left alone
+	dist = map[byte]float64{'a': 2}
+	applyIDF(dist, inverseByteFrequency([]byte("aaaa")))
+	if dist['a'] != 2 {
+		t.Errorf("single-byte corpus: weight %v, want it unchanged", dist['a'])
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	// Lowercase and N runs interrupt the bases; "Z" is only ever followed by "z"
+	idx := newTestIndex(t, "ACGTTGCA nnnn GATTACA NNN CCGGTTAA acgt TTAGGC Zzzz")
+	allowed := []byte("ACGT")
+	for seed := range int64(20) {
+		cfg := &Config{Allowed: allowed, Rand: rand.New(rand.NewSource(seed))}
+		for _, prompt := range []string{"GA", "nn", "Z"} {
+			text, _ := GenerateWithConfig(idx, prompt, 100, 1, 3, cfg)
+			if len(text) != 100 {
+				t.Errorf("seed %d, prompt %q: %d bytes, want 100", seed, prompt, len(text))
+			}
+			if i := strings.IndexFunc(text[len(prompt):], func(r rune) bool { return !strings.ContainsRune("ACGT", r) }); i >= 0 {
+				t.Errorf("seed %d, prompt %q: generated %q, with %q outside the allowed set", seed, prompt, text, text[len(prompt)+i])
+			}
+		}
+	}
+}
+
+func TestAllowedDeadEnd(t *testing.T) {
+	// After "AG" the corpus continues with "T", "A" or the disallowed "%"; after "T"
+	// only with "#", so every "T" is a dead end and draws uniformly from the allowed set
+	idx := newTestIndex(t, "AGT#AGA#AG%")
+	allowed := []byte("ACGT")
+	fallback := make(map[byte]int)
+	for seed := range int64(200) {
+		cfg := &Config{Allowed: allowed, Rand: rand.New(rand.NewSource(seed))}
+		for _, tok := range GenerateTokens(idx, "AG", 30, 1, 3, cfg) {
+			if !slices.Contains(allowed, tok.Byte) {
+				t.Fatalf("seed %d generated %q outside the allowed set", seed, tok.Byte)
+			}
+			if tok.N == 0 {
+				fallback[tok.Byte]++
+			}
+		}
+	}
+	total := 0
+	for _, n := range fallback {
+		total += n
+	}
+	for _, b := range allowed {
+		if fallback[b] < total/6 {
+			t.Errorf("dead ends drew %q %d of %d times, want about a quarter", b, fallback[b], total)
+		}
+	}
+}
+
+func TestMaxRunes(t *testing.T) {
+	// Two-, three- and four-byte runes
+	idx := newTestIndex(t, strings.Repeat("héllo wörld ünïcödé 世界 你好 🙂🙃 ", 10))
+	for seed := range int64(10) {
+		for _, maxRunes := range []int{1, 7, 40} {
+			cfg := &Config{MaxRunes: maxRunes, ValidUTF8: true, Rand: rand.New(rand.NewSource(seed))}
+			text, _ := GenerateWithConfig(idx, "hé", 1000, 1, 3, cfg)
+			generated := text[len("hé"):]
+			if !utf8.ValidString(generated) || utf8.RuneCountInString(generated) != maxRunes {
+				t.Errorf("seed %d: MaxRunes=%d generated %q, %d runes", seed, maxRunes, generated, utf8.RuneCountInString(generated))
+			}
+
+			// Raw bytes can break a sequence off, completing up to 3 extra runes at once
+			cfg = &Config{MaxRunes: maxRunes, Rand: rand.New(rand.NewSource(seed))}
+			text, _ = GenerateWithConfig(idx, "hé", 1000, 1, 3, cfg)
+			generated = text[len("hé"):]
+			if n := utf8.RuneCountInString(generated); n < maxRunes || n > maxRunes+3 || (utf8.ValidString(generated) && n != maxRunes) {
+				t.Errorf("seed %d, raw bytes: MaxRunes=%d generated %q, %d runes", seed, maxRunes, generated, n)
+			}
+		}
+	}
+}
+
+func TestMaxLines(t *testing.T) {
+	idx := newTestIndex(t, strings.Repeat("roses are red\nviolets are blue\nsugar is sweet\n", 5))
+	// Newlines in the prompt don't count
+	prompt := "roses are red\nviolets"
+	for seed := range int64(10) {
+		for _, maxLines := range []int{1, 3} {
+			cfg := &Config{MaxLines: maxLines, Rand: rand.New(rand.NewSource(seed))}
+			text, _ := GenerateWithConfig(idx, prompt, 10000, 0.8, 3, cfg)
+			generated := text[len(prompt):]
+			if n := strings.Count(generated, "\n"); n != maxLines || !strings.HasSuffix(generated, "\n") {
+				t.Errorf("seed %d: MaxLines=%d generated %q, with %d newlines", seed, maxLines, generated, n)
+			}
+		}
+	}
+
+	// maxChars still caps the output
+	text, _ := GenerateWithConfig(idx, prompt, len(prompt)+5, 0.8, 3, &Config{MaxLines: 3, Rand: rand.New(rand.NewSource(1))})
+	if len(text) != len(prompt)+5 {
+		t.Errorf("with MaxLines and a small maxChars, %d bytes, want %d", len(text), len(prompt)+5)
+	}
+}
+
+func TestKZero(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	// k=0 is auto, and without a MaxMatchThreshold that means every level
+	text, stats := GenerateWithConfig(idx, "the ", 100, 0.8, 0, &Config{Rand: rand.New(rand.NewSource(1))})
+	all, allStats := GenerateWithConfig(idx, "the ", 100, 0.8, -1, &Config{Rand: rand.New(rand.NewSource(1))})
+	if len(text) != 100 {
+		t.Fatalf("k=0 generated %q, want 100 bytes", text)
+	}
+	if text != all || len(stats) != len(allStats) {
+		t.Errorf("k=0 generated %q with %d levels, k=-1 %q with %d", text, len(stats), all, len(allStats))
+	}
+	if _, ns, _ := Sample(idx, "the ", 1, 0); len(ns) == 0 {
+		t.Error("Sample with k=0 used no levels")
+	}
+	if got, want := Perplexity(idx, "the cat sat.", 0, 100), Perplexity(idx, "the cat sat.", -1, 100); math.Abs(got-want) > 1e-9*want {
+		t.Errorf("perplexity with k=0 = %v, want %v as with k=-1", got, want)
+	}
+}
+
+func TestMinAcceptableN(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	// Only " t" of the prompt's suffixes occurs in the corpus
+	prompt := "zq t"
+	if text, _ := GenerateWithConfig(idx, prompt, 50, 0.8, 3, &Config{MinAcceptableN: 3}); text != prompt {
+		t.Errorf("with only a 2-byte match, generated %q, want just the prompt", text)
+	}
+	if text, _ := GenerateWithConfig(idx, prompt, 50, 0.8, 3, &Config{MinAcceptableN: 2, Rand: rand.New(rand.NewSource(1))}); len(text) == len(prompt) {
+		t.Errorf("with MinAcceptableN at the match length, generated %q, want more than the prompt", text)
+	}
+
+	// Under Strict, short matches fall back to the unigram distribution instead
+	for seed := range int64(10) {
+		cfg := &Config{MinAcceptableN: 3, Strict: true, Rand: rand.New(rand.NewSource(seed))}
+		tokens := GenerateTokens(idx, prompt, 80, 0.8, 3, cfg)
+		if len(tokens) != 80-len(prompt) {
+			t.Fatalf("seed %d: %d tokens under Strict, want %d", seed, len(tokens), 80-len(prompt))
+		}
+		if tokens[0].N != 0 {
+			t.Errorf("seed %d: first byte has n=%d, want the unigram fallback", seed, tokens[0].N)
+		}
+		for i, tok := range tokens {
+			if tok.N > 0 && tok.N < 3 {
+				t.Errorf("seed %d: token %d sampled from a %d-byte match", seed, i, tok.N)
+			}
+		}
+	}
+}
+
+func TestLevelContributions(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	prompt := "the "
+	for _, alpha := range []float64{0, 0.5} {
+		cfg := &Config{Alpha: alpha, Rand: rand.New(rand.NewSource(1))}
+		tokens := GenerateTokens(idx, prompt, 150, 1, 3, cfg)
+		text := prompt
+		for i, tok := range tokens {
+			dist, ns, _ := BuildDistribution(idx, text[max(0, len(text)-defaultContextWindow):], 3, cfg)
+			var total, sum float64
+			for _, w := range dist {
+				total += w
+			}
+			for _, c := range tok.Contributions {
+				sum += c
+			}
+			if len(tok.Contributions) != len(ns) {
+				t.Errorf("Alpha %v, token %d: %d contributions for %d levels", alpha, i, len(tok.Contributions), len(ns))
+			}
+			if want := dist[tok.Byte] / total; math.Abs(sum-want) > 1e-9 {
+				t.Errorf("Alpha %v, token %d (%q): contributions %v sum to %v, want its probability %v", alpha, i, tok.Byte, tok.Contributions, sum, want)
+			}
+			text += string(tok.Byte)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil)).With("seed", 7)
+	cfg := &Config{Logger: logger, ContextWindow: 32, Rand: rand.New(rand.NewSource(7))}
+	text, _ := GenerateWithConfig(idx, "the ", 30, 0.8, 3, cfg)
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("log isn't one JSON record: %v\n%s", err, buf.String())
+	}
+	want := map[string]any{
+		"msg":         "generate",
+		"prompt":      "the ",
+		"max_chars":   30.0,
+		"temp":        0.8,
+		"k":           3.0,
+		"context_len": 32.0,
+		"seed":        7.0,
+		"corpus":      CorpusHash([]byte(testCorpus)),
+		"generated":   float64(len(text) - len("the ")),
+	}
+	for key, v := range want {
+		if record[key] != v {
+			t.Errorf("%s = %v, want %v", key, record[key], v)
+		}
+	}
+	for _, key := range []string{"elapsed", "n_mean", "n_median"} {
+		if _, ok := record[key]; !ok {
+			t.Errorf("no %s in %s", key, buf.String())
+		}
+	}
+
+	// Logging doesn't change what's generated
+	if silent, _ := GenerateWithConfig(idx, "the ", 30, 0.8, 3, &Config{ContextWindow: 32, Rand: rand.New(rand.NewSource(7))}); silent != text {
+		t.Errorf("without a Logger generated %q, with one %q", silent, text)
+	}
+}
+
+func TestGenerateBatchAntithetic(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	prompt := "the "
+	// batchMean averages the first generated byte over a batch of 10. Samplers walk
+	// candidates in ascending byte order, so that byte grows with the draw and a
+	// pair's mirrored draws pull its two samples to opposite ends.
+	batchMean := func(cfg *Config) float64 {
+		batch := GenerateBatch(idx, prompt, 10, len(prompt)+1, 1, 3, cfg)
+		if len(batch) != 10 {
+			t.Fatalf("batch of %d, want 10", len(batch))
+		}
+		sum := 0.0
+		for _, s := range batch {
+			sum += float64(s[len(prompt)])
+		}
+		return sum / 10
+	}
+	variance := func(antithetic bool) float64 {
+		rng := rand.New(rand.NewSource(1))
+		var sum, sumSq float64
+		const trials = 300
+		for range trials {
+			m := batchMean(&Config{Antithetic: antithetic, Rand: rng})
+			sum += m
+			sumSq += m * m
+		}
+		mean := sum / trials
+		return sumSq/trials - mean*mean
+	}
+	iid, anti := variance(false), variance(true)
+	if anti >= iid {
+		t.Errorf("batch mean variance %v with antithetic pairs, %v without; want lower", anti, iid)
+	}
+}
+
+func TestSeededGeneration(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	distinct := make(map[string]bool)
+	for seed := range int64(5) {
+		a, _ := GenerateWithConfig(idx, "the ", 80, 1, 3, &Config{Rand: rand.New(rand.NewSource(seed))})
+		b, _ := GenerateWithConfig(idx, "the ", 80, 1, 3, &Config{Rand: rand.New(rand.NewSource(seed))})
+		if a != b {
+			t.Errorf("seed %d generated %q, then %q", seed, a, b)
+		}
+		distinct[a] = true
+	}
+	if len(distinct) == 1 {
+		t.Error("every seed generated the same text")
+	}
+	ch1, _, _ := SampleWithRand(idx, "the ", 1, 3, rand.New(rand.NewSource(9)))
+	ch2, _, _ := SampleWithRand(idx, "the ", 1, 3, rand.New(rand.NewSource(9)))
+	if ch1 != ch2 {
+		t.Errorf("SampleWithRand with one seed drew %q, then %q", ch1, ch2)
+	}
+}
+
+func TestSampleOrder(t *testing.T) {
+	// Walked in ascending byte order, "a" takes draws in [0, 0.25), "b" [0.25, 0.75)
+	// and "c" [0.75, 1), however the map happens to iterate
+	for _, tc := range []struct {
+		u    float64
+		want byte
+	}{{0.1, 'a'}, {0.3, 'b'}, {0.7, 'b'}, {0.8, 'c'}} {
+		for range 20 {
+			dist := map[byte]float64{'c': 1, 'b': 2, 'a': 1}
+			cfg := &Config{uniform: func() float64 { return tc.u }}
+			if got, _ := sampleWeighted(dist, 1, cfg); got != tc.want {
+				t.Fatalf("draw %v picked %q, want %q", tc.u, got, tc.want)
+			}
+		}
+	}
+
+	// So a fixed seed and prompt generate the same text on every run
+	idx := newTestIndex(t, testCorpus)
+	want, _ := GenerateWithConfig(idx, "the ", 200, 1, 3, &Config{Rand: rand.New(rand.NewSource(42))})
+	for range 10 {
+		if got, _ := GenerateWithConfig(idx, "the ", 200, 1, 3, &Config{Rand: rand.New(rand.NewSource(42))}); got != want {
+			t.Fatalf("seed 42 generated %q, then %q", want, got)
+		}
+	}
+}
+
+func TestSampleInfinigram(t *testing.T) {
+	// "yab" occurs once, "ab" three times and "b" five times, each time followed by a
+	// different digit
+	idx := newTestIndex(t, "xab1 yab2 zab3 wb4 vb5 ")
+	for _, tc := range []struct {
+		minCount, wantN int
+		want            string // bytes the chosen suffix is followed by
+	}{
+		{1, 3, "2"},
+		{2, 2, "123"},
+		{3, 2, "123"},
+		{4, 1, "12345"},
+		{5, 1, "12345"},
+	} {
+		for seed := range int64(10) {
+			ch, n, ok := SampleInfinigram(idx, "yab", 1, tc.minCount, &Config{Rand: rand.New(rand.NewSource(seed))})
+			if !ok || n != tc.wantN || !strings.ContainsRune(tc.want, rune(ch)) {
+				t.Errorf("minCount %d: drew %q from n=%d (%v), want one of %q from n=%d", tc.minCount, ch, n, ok, tc.want, tc.wantN)
+			}
+		}
+	}
+	if _, _, ok := SampleInfinigram(idx, "yab", 1, 6, nil); ok {
+		t.Error("minCount 6: a suffix qualified, want none")
+	}
+}
+
+func TestGenerateInfinigram(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	data := idx.Bytes()
+	// longestQualifying is the length of the longest suffix of context followed by at
+	// least minCount bytes in the corpus
+	longestQualifying := func(context string, minCount int) int {
+		for n := len(context); n > 0; n-- {
+			count := 0
+			for _, off := range idx.Lookup([]byte(context[len(context)-n:]), -1) {
+				if off+n < len(data) {
+					count++
+				}
+			}
+			if count >= minCount {
+				return n
+			}
+		}
+		return 0
+	}
+	for _, minCount := range []int{1, 2, 5} {
+		prompt := "the cat "
+		text, ns := GenerateInfinigram(idx, prompt, 120, 1, minCount, &Config{Rand: rand.New(rand.NewSource(3))})
+		if len(ns) != len(text)-len(prompt) {
+			t.Fatalf("minCount %d: %d suffix lengths for %d generated bytes", minCount, len(ns), len(text)-len(prompt))
+		}
+		for i, n := range ns {
+			pos := len(prompt) + i
+			context := text[max(0, pos-defaultContextWindow):pos]
+			if want := longestQualifying(context, minCount); n != want {
+				t.Errorf("minCount %d, byte %d: reported n=%d, want %d", minCount, i, n, want)
+			}
+			if suffix := context[len(context)-n:] + text[pos:pos+1]; Count(idx, suffix) == 0 {
+				t.Errorf("minCount %d, byte %d: %q never follows its suffix", minCount, i, text[pos])
+			}
+		}
+	}
+}
+
+func TestTrimStopKeepsPartialRune(t *testing.T) {
+	// Without ValidUTF8 the text is raw bytes, and a lead byte left at the end by
+	// trimming is kept
+	idx := newTestIndex(t, "ab\xe4END ab\xe4END")
+	text, _ := GenerateWithConfig(idx, "ab", 20, 0, 1, &Config{StopSequences: []string{"END"}, TrimStop: true})
+	if text != "ab\xe4" {
+		t.Errorf("text = %q, want %q", text, "ab\xe4")
+	}
+}
+
+func TestTrimStopStreaming(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	for seed := range int64(20) {
+		for _, stops := range [][]string{{"cat."}, {"the d", "at"}, {". "}} {
+			cfg := func() *Config {
+				return &Config{Rand: rand.New(rand.NewSource(seed)), StopSequences: stops, TrimStop: true}
+			}
+			text, _ := GenerateWithConfig(idx, "the ", 200, 1, 3, cfg())
+
+			var streamed []byte
+			stats := GenerateStreamWithConfig(idx, "the ", 200, 1, 3, cfg(), func(b byte) bool {
+				streamed = append(streamed, b)
+				return true
+			})
+			if want := text[len("the "):]; string(streamed) != want {
+				t.Fatalf("seed %d, stops %q: streamed %q, returned %q", seed, stops, streamed, want)
+			}
+			if n := len(stats[0].NHist); n > 0 {
+				var count int
+				for _, c := range stats[0].NHist {
+					count += c
+				}
+				if count != len(streamed) {
+					t.Errorf("seed %d, stops %q: stats cover %d bytes, %d streamed", seed, stops, count, len(streamed))
+				}
+			}
+			counted := cfg()
+			counted.OutputCounts = make(map[byte]int)
+			GenerateWithConfig(idx, "the ", 200, 1, 3, counted)
+			var total int
+			for _, c := range counted.OutputCounts {
+				total += c
+			}
+			if total != len(streamed) {
+				t.Errorf("seed %d, stops %q: OutputCounts tallies %d bytes, %d generated", seed, stops, total, len(streamed))
+			}
+			if tokens := GenerateTokens(idx, "the ", 200, 1, 3, cfg()); len(tokens) != len(streamed) {
+				t.Errorf("seed %d, stops %q: %d tokens for %d bytes", seed, stops, len(tokens), len(streamed))
+			}
+		}
+	}
+}
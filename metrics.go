@@ -0,0 +1,119 @@
+package infinigram
+
+import (
+	"index/suffixarray"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// DistinctN returns the fraction of length-n substrings of text that are distinct, a
+// common diversity measure: 1 means no n-gram repeats, values near 0 mean heavy
+// repetition. Text shorter than n yields 0.
+func DistinctN(text string, n int) float64 {
+	if n <= 0 || len(text) < n {
+		return 0
+	}
+	seen := make(map[string]struct{})
+	for i := 0; i+n <= len(text); i++ {
+		seen[text[i:i+n]] = struct{}{}
+	}
+	return float64(len(seen)) / float64(len(text)-n+1)
+}
+
+// NoveltyRate returns the fraction of length-n substrings of text that never occur in
+// the corpus. 0 means the text is stitched entirely from corpus n-grams; higher values
+// mean the model recombines rather than copies. Text shorter than n yields 0.
+func NoveltyRate(idx *suffixarray.Index, text string, n int) float64 {
+	if n <= 0 || len(text) < n {
+		return 0
+	}
+	novel := 0
+	for i := 0; i+n <= len(text); i++ {
+		if len(idx.Lookup([]byte(text[i:i+n]), 1)) == 0 {
+			novel++
+		}
+	}
+	return float64(novel) / float64(len(text)-n+1)
+}
+
+// TemperatureResult is one generation from a CompareTemperatures sweep.
+type TemperatureResult struct {
+	Temp                 float64
+	Text                 string
+	Distinct1, Distinct2 float64
+	// MeanLogProb is the model's mean natural-log probability of the generated bytes
+	// (the prompt excluded), a measure of how confident the generation is.
+	MeanLogProb float64
+}
+
+// CompareTemperatures generates from prompt once per temperature and reports each
+// output's diversity and mean log-probability. Every run starts from a fresh RNG with
+// the same seed so differences come from the temperature alone.
+func CompareTemperatures(idx *suffixarray.Index, prompt string, maxChars int, temps []float64, k int, seed int64) []TemperatureResult {
+	results := make([]TemperatureResult, len(temps))
+	for i, temp := range temps {
+		cfg := &Config{Rand: rand.New(rand.NewSource(seed))}
+		text, _ := GenerateWithConfig(idx, prompt, maxChars, temp, k, cfg)
+		results[i] = TemperatureResult{
+			Temp:        temp,
+			Text:        text,
+			Distinct1:   DistinctN(text, 1),
+			Distinct2:   DistinctN(text, 2),
+			MeanLogProb: meanGeneratedLogProb(idx, text, len(prompt), k),
+		}
+	}
+	return results
+}
+
+// meanGeneratedLogProb averages the log-probability of text[from:] under the model,
+// using the same default context window as generation.
+func meanGeneratedLogProb(idx *suffixarray.Index, text string, from, k int) float64 {
+	lps, _ := logProbs(idx, text, k, defaultContextWindow, nil)
+	from = max(from, 1) // lps[i-1] scores text[i]
+	if from >= len(text) {
+		return 0
+	}
+	var sum float64
+	for _, lp := range lps[from-1:] {
+		sum += lp
+	}
+	return sum / float64(len(text)-from)
+}
+
+// calibrationChars is how many bytes EstimateCost generates to time a request.
+const calibrationChars = 100
+
+// EstimateCost predicts how fast a request to generate maxChars bytes with k levels
+// would run and how much memory it needs, for deciding whether to accept it. Speed
+// comes from a short strict calibration run whose prompt is the first contextLen
+// corpus bytes. Memory covers the index (the corpus plus its suffix array) and the
+// generated text and per-level stats. Treat both as rough: speed varies with how
+// well the prompt matches, and estimates are usually within a factor of 2-3.
+func EstimateCost(idx *suffixarray.Index, contextLen, maxChars, k int) (charsPerSec float64, estBytes int) {
+	data := idx.Bytes()
+	prompt := string(data[:min(max(contextLen, 1), len(data))])
+	cfg := &Config{Strict: true, Rand: rand.New(rand.NewSource(1))}
+
+	levels := 0
+	start := time.Now()
+	out, _ := generate(idx, prompt, len(prompt)+min(maxChars, calibrationChars), 1, k, cfg, func(st genStep) bool {
+		levels = max(levels, len(st.ns))
+		return true
+	})
+	elapsed := time.Since(start).Seconds()
+	if generated := len(out) - len(prompt); generated > 0 && elapsed > 0 {
+		charsPerSec = float64(generated) / elapsed
+	} else {
+		charsPerSec = math.Inf(1)
+	}
+
+	// index/suffixarray stores offsets as int32 below 2 GiB and int64 above
+	offsetSize := 4
+	if len(data) > math.MaxInt32 {
+		offsetSize = 8
+	}
+	// Per generated byte: the byte itself plus an n value and match count per level
+	estBytes = len(data)*(1+offsetSize) + maxChars*(1+16*levels)
+	return charsPerSec, estBytes
+}
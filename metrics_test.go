@@ -0,0 +1,84 @@
+package infinigram
+
+import (
+	"math/rand"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompareTemperatures(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	temps := []float64{0, 0.5, 1.5, 0.5}
+	results := CompareTemperatures(idx, "the ", 200, temps, 3, 1)
+	if len(results) != len(temps) {
+		t.Fatalf("%d results for %d temperatures", len(results), len(temps))
+	}
+	for i, r := range results {
+		if r.Temp != temps[i] {
+			t.Errorf("result %d is for temperature %v, want %v", i, r.Temp, temps[i])
+		}
+		if len(r.Text) != 200 {
+			t.Errorf("temperature %v: %d bytes of text, want 200", r.Temp, len(r.Text))
+		}
+		if r.Distinct1 != DistinctN(r.Text, 1) || r.Distinct2 != DistinctN(r.Text, 2) {
+			t.Errorf("temperature %v: distinct-1/2 %v/%v, want those of its text", r.Temp, r.Distinct1, r.Distinct2)
+		}
+		if !(r.MeanLogProb <= 0) {
+			t.Errorf("temperature %v: mean log-probability %v, want <= 0", r.Temp, r.MeanLogProb)
+		}
+	}
+	// Every run uses the same seed, and greedy output is the most probable
+	if results[1].Text != results[3].Text {
+		t.Errorf("the same temperature gave different text:\n%q\n%q", results[1].Text, results[3].Text)
+	}
+	if results[0].MeanLogProb <= results[2].MeanLogProb {
+		t.Errorf("mean log-probability %v at temperature 0, want above %v at 1.5", results[0].MeanLogProb, results[2].MeanLogProb)
+	}
+}
+
+func TestEstimateCost(t *testing.T) {
+	corpus := []byte(strings.Repeat(testCorpus+" ", 300))
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	idx := newTestIndex(t, string(corpus))
+
+	const contextLen, maxChars = 50, 1000
+	speed, mem := EstimateCost(idx, contextLen, maxChars, 3)
+
+	prompt := string(corpus[:contextLen])
+	start := time.Now()
+	text, stats := GenerateWithConfig(idx, prompt, contextLen+maxChars, 1, 3, &Config{Strict: true, Rand: rand.New(rand.NewSource(2))})
+	actualSpeed := float64(len(text)-len(prompt)) / time.Since(start).Seconds()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	actualMem := int(after.HeapAlloc - before.HeapAlloc)
+	runtime.KeepAlive(idx)
+	runtime.KeepAlive(stats)
+
+	if ratio := speed / actualSpeed; ratio < 0.1 || ratio > 10 {
+		t.Errorf("estimated %.0f chars/s, measured %.0f", speed, actualSpeed)
+	}
+	if ratio := float64(mem) / float64(actualMem); ratio < 0.1 || ratio > 10 {
+		t.Errorf("estimated %d bytes, measured %d", mem, actualMem)
+	}
+}
+
+func TestNoveltyRate(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	copied := testCorpus[20:120]
+	for _, n := range []int{1, 4, 20} {
+		if got := NoveltyRate(idx, copied, n); got != 0 {
+			t.Errorf("novelty of copied text with n=%d = %v, want 0", n, got)
+		}
+	}
+	// Of its six 4-grams, only "the " occurs in the corpus
+	if got := NoveltyRate(idx, "the zebra", 4); got != 5.0/6 {
+		t.Errorf("novelty of %q = %v, want 5/6", "the zebra", got)
+	}
+	if got := NoveltyRate(idx, "the", 4); got != 0 {
+		t.Errorf("novelty of text shorter than n = %v, want 0", got)
+	}
+}
@@ -0,0 +1,47 @@
+package infinigram
+
+import "index/suffixarray"
+
+// GenerateMixture generates from several models at once: at each step every model's
+// next-byte distribution is normalized and they are mixed as sum(weights[i]*P_i) over
+// the union of their candidates, then sampled with temperature (greedily at temp 0).
+// Models whose context has no match sit that step out and the rest are renormalized;
+// generation ends when none match.
+//
+// cfg's level settings (those BuildDistribution honors, from StartN to Interpolation)
+// shape each model's distribution, ContextWindow and EOS pick the context, and Rand,
+// TopK, TopP, MinProbFloor and Debug apply to the mixed draw. Settings handled by the
+// Generate loop itself don't: Strict, Allowed's uniform fallback, PrimeBias,
+// RepetitionPenalty, IDFWeighting, CorpusAlphabetOnly, ValidUTF8, phrase shortcuts,
+// MinAcceptableN, stop conditions, Restarts, OutputCounts, LookupCacheSize and
+// Logger. With weights like {1, 0} and none of those set, the output is exactly what
+// GenerateWithConfig gives for the first model with the same random source.
+func GenerateMixture(models []*suffixarray.Index, weights []float64, prompt string, maxChars int, temp float64, k int, cfg *Config) string {
+	result := []byte(prompt)
+	for len(result) < maxChars {
+		context := string(cfg.context(result))
+		mixed := make(map[byte]float64)
+		for i, idx := range models {
+			if i >= len(weights) || weights[i] <= 0 {
+				continue
+			}
+			dist, _, _ := BuildDistribution(idx, context, k, cfg)
+			var total float64
+			for _, w := range dist {
+				total += w
+			}
+			if total <= 0 {
+				continue
+			}
+			for ch, w := range dist {
+				mixed[ch] += weights[i] * w / total
+			}
+		}
+		ch, ok := sampleWeighted(mixed, temp, cfg)
+		if !ok {
+			break
+		}
+		result = append(result, ch)
+	}
+	return string(result)
+}
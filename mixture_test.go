@@ -0,0 +1,42 @@
+package infinigram
+
+import (
+	"index/suffixarray"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestGenerateMixture(t *testing.T) {
+	general := newTestIndex(t, testCorpus)
+	domain := newTestIndex(t, "the zebra zigzags past the zoo. the zoo keeper zips the gate.")
+	models := []*suffixarray.Index{general, domain}
+	for seed := range int64(10) {
+		want, _ := GenerateWithConfig(general, "the ", 60, 0.8, 3, &Config{Rand: rand.New(rand.NewSource(seed))})
+		got := GenerateMixture(models, []float64{1, 0}, "the ", 60, 0.8, 3, &Config{Rand: rand.New(rand.NewSource(seed))})
+		if got != want {
+			t.Errorf("seed %d: lambda=1 generated %q, model 1 alone %q", seed, got, want)
+		}
+		want, _ = GenerateWithConfig(domain, "the ", 60, 0.8, 3, &Config{Rand: rand.New(rand.NewSource(seed))})
+		got = GenerateMixture(models, []float64{0, 1}, "the ", 60, 0.8, 3, &Config{Rand: rand.New(rand.NewSource(seed))})
+		if got != want {
+			t.Errorf("seed %d: lambda=0 generated %q, model 2 alone %q", seed, got, want)
+		}
+	}
+
+	// An even mix draws from the union of the two models' candidates
+	var sawGeneral, sawDomain bool
+	for seed := range int64(20) {
+		text := GenerateMixture(models, []float64{0.5, 0.5}, "the ", 5, 1, 3, &Config{Rand: rand.New(rand.NewSource(seed))})
+		sawDomain = sawDomain || strings.HasPrefix(text, "the z")
+		sawGeneral = sawGeneral || !strings.HasPrefix(text, "the z")
+	}
+	if !sawGeneral || !sawDomain {
+		t.Errorf("an even mix drew from model 1: %v, model 2: %v; want both", sawGeneral, sawDomain)
+	}
+
+	// Generation ends once no model matches
+	if got := GenerateMixture(models, []float64{0.5, 0.5}, "q", 10, 1, 3, nil); got != "q" {
+		t.Errorf("with no match anywhere generated %q, want just the prompt", got)
+	}
+}
@@ -0,0 +1,106 @@
+package infinigram
+
+import (
+	"index/suffixarray"
+	"math/rand"
+)
+
+// Model bundles an index with its sampling and scoring settings, so they are chosen
+// once at construction instead of passed to every call. A Model with a random source
+// (see WithSeed) is not safe for concurrent use; build one per goroutine over a shared
+// index.
+type Model struct {
+	idx        *suffixarray.Index
+	temp       float64
+	k          int
+	contextLen int
+	cfg        Config
+}
+
+// Option configures a Model in NewModel.
+type Option func(*Model)
+
+// NewModel returns a Model over idx. Without options it samples at temperature 0.8
+// from k=3 levels and scores with 100 bytes of context, like the command-line tool,
+// with every Config field at its default.
+func NewModel(idx *suffixarray.Index, opts ...Option) *Model {
+	m := &Model{idx: idx, temp: 0.8, k: 3, contextLen: 100}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// WithTemperature sets the sampling temperature; 0 decodes greedily.
+func WithTemperature(temp float64) Option {
+	return func(m *Model) { m.temp = temp }
+}
+
+// WithK sets the number of n-gram levels to mix, as the k argument of Generate.
+func WithK(k int) Option {
+	return func(m *Model) { m.k = k }
+}
+
+// WithContextLen sets how many preceding bytes Perplexity conditions on.
+func WithContextLen(n int) Option {
+	return func(m *Model) { m.contextLen = n }
+}
+
+// WithConfig replaces all of the Model's Config settings with a copy of cfg. Later
+// options still apply on top of it.
+func WithConfig(cfg Config) Option {
+	return func(m *Model) { m.cfg = cfg }
+}
+
+// WithSeed makes sampling reproducible by drawing from a source seeded with seed.
+func WithSeed(seed int64) Option {
+	return func(m *Model) { m.cfg.Rand = rand.New(rand.NewSource(seed)) }
+}
+
+// WithDecay sets Config.Decay.
+func WithDecay(decay float64) Option {
+	return func(m *Model) { m.cfg.Decay = decay }
+}
+
+// WithContextWindow sets Config.ContextWindow.
+func WithContextWindow(n int) Option {
+	return func(m *Model) { m.cfg.ContextWindow = n }
+}
+
+// WithTopK sets Config.TopK.
+func WithTopK(topK int) Option {
+	return func(m *Model) { m.cfg.TopK = topK }
+}
+
+// WithTopP sets Config.TopP.
+func WithTopP(topP float64) Option {
+	return func(m *Model) { m.cfg.TopP = topP }
+}
+
+// Index returns the Model's index.
+func (m *Model) Index() *suffixarray.Index {
+	return m.idx
+}
+
+// Generate is GenerateWithConfig with the Model's settings.
+func (m *Model) Generate(prompt string, maxChars int) (string, []LevelStats) {
+	return GenerateWithConfig(m.idx, prompt, maxChars, m.temp, m.k, &m.cfg)
+}
+
+// Sample is SampleWithConfig with the Model's settings: the next byte after context
+// plus the n and numMatches at each level.
+func (m *Model) Sample(context string) (byte, []int, []int) {
+	return SampleWithConfig(m.idx, context, m.temp, m.k, &m.cfg)
+}
+
+// NewSampler is NewSampler over the Model's index and Config, seeded with seed. Use one
+// per goroutine to sample concurrently from one Model. Its Sample and Generate methods
+// still take the temperature and k.
+func (m *Model) NewSampler(seed int64) *Sampler {
+	return NewSampler(m.idx, &m.cfg, seed)
+}
+
+// Perplexity is PerplexityWithConfig with the Model's settings.
+func (m *Model) Perplexity(text string) float64 {
+	return PerplexityWithConfig(m.idx, text, m.k, m.contextLen, &m.cfg)
+}
@@ -0,0 +1,72 @@
+package infinigram
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestModelNewSampler(t *testing.T) {
+	m := NewModel(newTestIndex(t, testCorpus), WithTopK(1))
+
+	// TopK=1 from the Model's Config leaves only the most likely byte at any
+	// temperature
+	s := m.NewSampler(1)
+	want, _ := Generate(m.Index(), "the d", 80, 0, 3)
+	if got, _ := s.Generate("the d", 80, 2, 3); got != want {
+		t.Errorf("Generate with TopK=1 = %q, want the greedy %q", got, want)
+	}
+
+	// Samplers with the same seed draw the same bytes
+	m = NewModel(m.Index())
+	a, _ := m.NewSampler(7).Generate("the ", 120, 1, 3)
+	b, _ := m.NewSampler(7).Generate("the ", 120, 1, 3)
+	if a != b {
+		t.Errorf("same seed generated %q and %q", a, b)
+	}
+}
+
+func TestConcurrentSamplers(t *testing.T) {
+	m := NewModel(newTestIndex(t, testCorpus), WithConfig(Config{LookupCacheSize: 64, MaxOffsets: 4}))
+	const samplers = 8
+	want := make([]string, samplers)
+	for i := range want {
+		want[i], _ = m.NewSampler(int64(i)).Generate("the ", 200, 1, 3)
+	}
+
+	// Run with -race: Samplers share the Model's index but nothing mutable
+	got := make([]string, samplers)
+	var wg sync.WaitGroup
+	for i := range samplers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := m.NewSampler(int64(i))
+			got[i], _ = s.Generate("the ", 200, 1, 3)
+			for range 50 {
+				s.Sample("the c", 1, 3)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("sampler %d generated %q concurrently, %q alone", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSamplerGenerateReusesScratch(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	s := NewSampler(idx, nil, 5)
+	got, _ := s.Generate("the ", 200, 1, 3)
+	want, _ := GenerateWithConfig(idx, "the ", 200, 1, 3, &Config{Rand: rand.New(rand.NewSource(5))})
+	if got != want {
+		t.Errorf("Sampler generated %q, GenerateWithConfig with the same seed %q", got, want)
+	}
+
+	// The steps' distributions went into the Sampler's own map
+	if len(s.dist) == 0 {
+		t.Error("Generate left the Sampler's scratch map empty")
+	}
+}
@@ -0,0 +1,561 @@
+package infinigram
+
+import (
+	"index/suffixarray"
+	"math"
+	"sort"
+	"sync"
+)
+
+// Perplexity computes perplexity on the given text, i.e. exp(CrossEntropy).
+func Perplexity(idx *suffixarray.Index, text string, k int, contextLen int) float64 {
+	return PerplexityWithConfig(idx, text, k, contextLen, nil)
+}
+
+// PerplexityWithConfig is like Perplexity but takes optional settings. A nil cfg
+// behaves like Perplexity.
+func PerplexityWithConfig(idx *suffixarray.Index, text string, k int, contextLen int, cfg *Config) float64 {
+	return math.Exp(crossEntropy(cfg.scored(logProbs(idx, text, k, contextLen, cfg))))
+}
+
+// CrossEntropy returns the mean negative natural-log probability the model assigns to
+// each character of text[1:], using up to contextLen preceding characters as context.
+func CrossEntropy(idx *suffixarray.Index, text string, k int, contextLen int) float64 {
+	lps, _ := logProbs(idx, text, k, contextLen, nil)
+	return crossEntropy(lps)
+}
+
+// BitsPerChar returns the cross-entropy of text in bits per character, log2 of
+// Perplexity. It is the standard metric for comparing character-level models.
+func BitsPerChar(idx *suffixarray.Index, text string, k int, contextLen int) float64 {
+	return CrossEntropy(idx, text, k, contextLen) / math.Ln2
+}
+
+// PerplexityDetailed computes perplexity on the given text and also returns the
+// natural-log probability assigned to each scored position (text[1:]).
+func PerplexityDetailed(idx *suffixarray.Index, text string, k int, contextLen int) (float64, []float64) {
+	lps, _ := logProbs(idx, text, k, contextLen, nil)
+	return math.Exp(crossEntropy(lps)), lps
+}
+
+// ScoreContinuation returns the total natural-log probability the model assigns to
+// continuation following context, scoring each of its characters with up to
+// contextLen preceding characters of context+continuation. Higher is better; compare
+// candidates of equal length, or divide by length for a per-character score. With an
+// empty context the first character has nothing to condition on and isn't scored.
+func ScoreContinuation(idx *suffixarray.Index, context, continuation string, k int, contextLen int) float64 {
+	lps, _ := logProbs(idx, context+continuation, k, contextLen, &Config{SkipPrefix: len(context)})
+	var total float64
+	for _, lp := range lps {
+		total += lp
+	}
+	return total
+}
+
+// Evaluation summarizes how well the model predicts a text.
+type Evaluation struct {
+	Perplexity  float64
+	BitsPerChar float64 // log2(Perplexity), the usual metric for character-level models
+	Positions   int     // characters scored, i.e. len(text)-max(1, cfg.SkipPrefix)
+	Unmatched   int     // positions whose context matched nothing in the corpus
+	Floored     int     // positions given the smoothing floor (Config.Epsilon), matched or not
+	Coverage    float64 // fraction of positions with a match, 1 - Unmatched/Positions
+}
+
+// Evaluate scores text like PerplexityWithConfig and also reports bits per character,
+// how many positions had no match at all, and how many got the smoothing floor.
+// Unmatched positions get the floor (unless cfg.AddK gives them a probability), or are
+// left out of the perplexity when cfg.SkipUnmatched is set; either way Coverage plus
+// the unmatched fraction accounts for every position.
+func Evaluate(idx *suffixarray.Index, text string, k int, contextLen int, cfg *Config) Evaluation {
+	lps, matched := logProbs(idx, text, k, contextLen, cfg)
+	ce := crossEntropy(cfg.scored(lps, matched))
+	ev := Evaluation{
+		Perplexity:  math.Exp(ce),
+		BitsPerChar: ce / math.Ln2,
+		Positions:   len(lps),
+	}
+	for i, m := range matched {
+		if !m {
+			ev.Unmatched++
+		}
+		if lps[i] == math.Log(cfg.epsilon()) {
+			ev.Floored++
+		}
+	}
+	if ev.Positions > 0 {
+		ev.Coverage = 1 - float64(ev.Unmatched)/float64(ev.Positions)
+	}
+	return ev
+}
+
+// EvaluateMany returns the perplexity of each text, in order, as Perplexity would.
+func EvaluateMany(idx *suffixarray.Index, texts []string, k int, contextLen int) []float64 {
+	return EvaluateManyWithConfig(idx, texts, k, contextLen, nil)
+}
+
+// EvaluateManyWithConfig is like EvaluateMany but takes optional settings, and scores
+// up to cfg.Workers texts concurrently (sequentially if cfg.MaxOffsets is set).
+func EvaluateManyWithConfig(idx *suffixarray.Index, texts []string, k int, contextLen int, cfg *Config) []float64 {
+	ppls := make([]float64, len(texts))
+	workers := min(cfg.workers(), len(texts))
+	if workers <= 1 {
+		for i, text := range texts {
+			ppls[i] = PerplexityWithConfig(idx, text, k, contextLen, cfg)
+		}
+		return ppls
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				ppls[i] = PerplexityWithConfig(idx, texts[i], k, contextLen, cfg)
+			}
+		}()
+	}
+	for i := range texts {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return ppls
+}
+
+// logProbs returns the natural-log probability of each scored character of text, and
+// whether its context had any match in the corpus. Scoring starts at text[1], or at
+// text[cfg.SkipPrefix] if that is later.
+//
+// With cfg.Workers above one, contiguous chunks of positions are scored concurrently,
+// each worker with its own scorer. Every position still reads its context from the
+// whole text, so the result is the same as scoring sequentially.
+func logProbs(idx *suffixarray.Index, text string, k int, contextLen int, cfg *Config) ([]float64, []bool) {
+	first := max(1, cfg.skipPrefix())
+	workers := cfg.workers()
+	if workers <= 1 || len(text)-first < 2*logProbChunk {
+		return newScorer(idx, k, cfg).logProbs(text, contextLen)
+	}
+
+	n := len(text) - first
+	lps := make([]float64, n)
+	matched := make([]bool, n)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(workers, (n+logProbChunk-1)/logProbChunk) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sc := newScorer(idx, k, cfg)
+			for start := range next {
+				for i := start; i < min(start+logProbChunk, n); i++ {
+					pos := first + i
+					lps[i], matched[i] = sc.logProb(text[max(0, pos-contextLen):pos], text[pos], cfg.excludedPos(pos))
+				}
+			}
+		}()
+	}
+	for start := 0; start < n; start += logProbChunk {
+		next <- start
+	}
+	close(next)
+	wg.Wait()
+	return lps, matched
+}
+
+// logProbChunk is how many consecutive positions a scoring worker takes at a time.
+const logProbChunk = 256
+
+// logProbs is logProbs using sc, so its cache can be shared between runs.
+func (sc *scorer) logProbs(text string, contextLen int) ([]float64, []bool) {
+	cfg := sc.cfg
+	first := max(1, cfg.skipPrefix())
+	lps := make([]float64, 0, max(0, len(text)-first))
+	matched := make([]bool, 0, max(0, len(text)-first))
+	for i := first; i < len(text); i++ {
+		start := max(0, i-contextLen)
+		lp, ok := sc.logProb(text[start:i], text[i], cfg.excludedPos(i))
+		lps = append(lps, lp)
+		matched = append(matched, ok)
+	}
+	return lps, matched
+}
+
+// PerplexityVsContext computes the perplexity of text at each context window size in
+// contextLens, to find where more context stops helping. Positions whose whole
+// history fits in several windows see the same context, so their distributions are
+// computed once and shared across sizes.
+func PerplexityVsContext(idx *suffixarray.Index, text string, k int, contextLens []int) map[int]float64 {
+	sc := newScorer(idx, k, nil)
+	sc.cache = newLRUCache[map[byte]float64](max(1, len(text)))
+	curve := make(map[int]float64, len(contextLens))
+	for _, contextLen := range contextLens {
+		lps, _ := sc.logProbs(text, contextLen)
+		curve[contextLen] = math.Exp(crossEntropy(lps))
+	}
+	return curve
+}
+
+// distributionCacheSize bounds the context cache of DistributionsOverText.
+const distributionCacheSize = 4096
+
+// DistributionsOverText returns the normalized next-byte distribution at every position
+// of text: entry i is the distribution of the byte after text[:i+1], using up to
+// contextLen bytes of context, so entry i-1 is what the model predicted for text[i].
+// Entries are nil where no suffix of the context matches. Each entry is a new map; use
+// ForEachDistribution to avoid holding them all at once.
+func DistributionsOverText(idx *suffixarray.Index, text string, k int, contextLen int) []map[byte]float64 {
+	return DistributionsOverTextWithConfig(idx, text, k, contextLen, nil)
+}
+
+// DistributionsOverTextWithConfig is like DistributionsOverText but takes optional
+// settings, as ForEachDistributionWithConfig does.
+func DistributionsOverTextWithConfig(idx *suffixarray.Index, text string, k int, contextLen int, cfg *Config) []map[byte]float64 {
+	dists := make([]map[byte]float64, 0, len(text))
+	ForEachDistributionWithConfig(idx, text, k, contextLen, cfg, func(_ int, dist map[byte]float64) bool {
+		dists = append(dists, dist)
+		return true
+	})
+	return dists
+}
+
+// ForEachDistribution is the streaming form of DistributionsOverText: it calls fn with
+// each position and its distribution in order, stopping early if fn returns false.
+// Repeated contexts are served from a bounded cache.
+func ForEachDistribution(idx *suffixarray.Index, text string, k int, contextLen int, fn func(i int, dist map[byte]float64) bool) {
+	ForEachDistributionWithConfig(idx, text, k, contextLen, nil, fn)
+}
+
+// ForEachDistributionWithConfig is like ForEachDistribution but takes optional
+// settings. Distributions come from the same scorer as PerplexityWithConfig, so the
+// level settings, EOS, LeaveOneOut and AddK apply, and entry i-1 gives text[i] the
+// probability scoring does; bytes missing from an entry are the ones scoring charges
+// the Epsilon floor. With AddK an unmatched context still gets the smoothing
+// distribution rather than nil. With cfg.Workers above one, chunks of positions are
+// computed concurrently and still passed to fn in order. A nil cfg behaves like
+// ForEachDistribution.
+func ForEachDistributionWithConfig(idx *suffixarray.Index, text string, k int, contextLen int, cfg *Config, fn func(i int, dist map[byte]float64) bool) {
+	workers := cfg.workers()
+	scorers := make([]*scorer, workers)
+	for w := range scorers {
+		scorers[w] = newScorer(idx, k, cfg)
+		if scorers[w].cache == nil && !(cfg != nil && cfg.LeaveOneOut) {
+			scorers[w].cache = newLRUCache[map[byte]float64](distributionCacheSize)
+		}
+	}
+	at := func(sc *scorer, i int) map[byte]float64 {
+		return sc.probs(text[max(0, i+1-contextLen):i+1], cfg.excludedPos(i+1))
+	}
+	if workers <= 1 {
+		for i := range len(text) {
+			if !fn(i, at(scorers[0], i)) {
+				return
+			}
+		}
+		return
+	}
+
+	// Fill one chunk per worker concurrently, then hand the batch to fn in order
+	batch := make([]map[byte]float64, workers*logProbChunk)
+	for start := 0; start < len(text); start += len(batch) {
+		n := min(len(batch), len(text)-start)
+		var wg sync.WaitGroup
+		for w := 0; w*logProbChunk < n; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := w * logProbChunk; j < min((w+1)*logProbChunk, n); j++ {
+					batch[j] = at(scorers[w], start+j)
+				}
+			}()
+		}
+		wg.Wait()
+		for j, dist := range batch[:n] {
+			if !fn(start+j, dist) {
+				return
+			}
+		}
+	}
+}
+
+// scored returns the log-probabilities that count toward perplexity: all of them, or
+// only the matched positions under SkipUnmatched.
+func (c *Config) scored(lps []float64, matched []bool) []float64 {
+	if c == nil || !c.SkipUnmatched {
+		return lps
+	}
+	var kept []float64
+	for i, lp := range lps {
+		if matched[i] {
+			kept = append(kept, lp)
+		}
+	}
+	return kept
+}
+
+// crossEntropy returns the mean of -lps.
+func crossEntropy(lps []float64) float64 {
+	var logProbSum float64
+	for _, lp := range lps {
+		logProbSum += lp
+	}
+	return -logProbSum / float64(len(lps))
+}
+
+// scorer holds the state shared by every position of a scoring run.
+type scorer struct {
+	idx *suffixarray.Index
+	k   int
+	cfg *Config
+	// alphabet is the set of bytes add-k smoothing spreads mass over
+	alphabet     [256]bool
+	alphabetSize int
+	// cache memoizes distributions by context, or is nil when caching is off
+	cache *lruCache[map[byte]float64]
+}
+
+func newScorer(idx *suffixarray.Index, k int, cfg *Config) *scorer {
+	sc := &scorer{idx: idx, k: k, cfg: cfg}
+	if cfg != nil && cfg.AddK > 0 {
+		sc.alphabet, sc.alphabetSize = corpusAlphabet(idx.Bytes())
+		if cfg.AddKAllBytes {
+			for b := range sc.alphabet {
+				sc.alphabet[b] = true
+			}
+			sc.alphabetSize = len(sc.alphabet)
+		}
+	}
+	// Leave-one-out distributions depend on the position, not just the context
+	if cfg != nil && cfg.CacheSize > 0 && !cfg.LeaveOneOut {
+		sc.cache = newLRUCache[map[byte]float64](cfg.CacheSize)
+	}
+	return sc
+}
+
+// distribution returns the unnormalized next-byte distribution for context, ignoring
+// a continuation at corpus position exclude (-1 for none).
+func (sc *scorer) distribution(context string, exclude int) map[byte]float64 {
+	if sc.cache != nil {
+		if dist, ok := sc.cache.get(context); ok {
+			return dist
+		}
+	}
+	dist, _, _ := combineLevels(findLevels(sc.idx, context, sc.k, sc.cfg, exclude), sc.cfg)
+	if sc.cache != nil {
+		sc.cache.put(context, dist)
+	}
+	return dist
+}
+
+// logProb returns the natural-log probability of next following context, ignoring a
+// continuation at corpus position exclude (-1 for none). It also reports whether any
+// suffix of the context matched.
+func (sc *scorer) logProb(context string, next byte, exclude int) (float64, bool) {
+	dist := sc.distribution(context, exclude)
+	if p := sc.prob(dist, weightSum(dist), next); p > 0 {
+		return math.Log(p), dist != nil
+	}
+	// Smoothing for unseen characters
+	return math.Log(sc.cfg.epsilon()), dist != nil
+}
+
+// prob returns the smoothed probability of next under dist, an unnormalized
+// distribution whose weights sum to total, before the floor for unseen characters.
+func (sc *scorer) prob(dist map[byte]float64, total float64, next byte) float64 {
+	var p float64
+	if total > 0 {
+		p = dist[next] / total
+	}
+	if sc.alphabetSize > 0 && sc.alphabet[next] {
+		// Add-k: spread AddK mass uniformly over the corpus alphabet, then renormalize.
+		// With no match at all, this leaves a uniform distribution over the alphabet.
+		uniform := 1 / float64(sc.alphabetSize)
+		if total == 0 {
+			p = uniform
+		} else {
+			p = (p + sc.cfg.AddK*uniform) / (1 + sc.cfg.AddK)
+		}
+	}
+	return p
+}
+
+// probs returns the normalized distribution of the byte after context, with the
+// smoothing logProb applies, as a new map, or nil if no byte gets any probability.
+func (sc *scorer) probs(context string, exclude int) map[byte]float64 {
+	dist := sc.distribution(context, exclude)
+	total := weightSum(dist)
+	var probs map[byte]float64
+	add := func(ch byte) {
+		if p := sc.prob(dist, total, ch); p > 0 {
+			if probs == nil {
+				probs = make(map[byte]float64, len(dist))
+			}
+			probs[ch] = p
+		}
+	}
+	if sc.alphabetSize > 0 {
+		// Smoothing can give any byte of the alphabet a share
+		for b := range 256 {
+			add(byte(b))
+		}
+		return probs
+	}
+	// The cached map is shared, so normalize into a new one
+	for ch := range dist {
+		add(ch)
+	}
+	return probs
+}
+
+// weightSum returns the sum of the weights in dist.
+func weightSum(dist map[byte]float64) float64 {
+	var total float64
+	for _, w := range dist {
+		total += w
+	}
+	return total
+}
+
+// Surprisal returns how surprised the model is by each character of text[1:], in bits:
+// entry i-1 is -log2 p(text[i]) given up to contextLen preceding characters. It is
+// PerplexityDetailed's log-probabilities converted to bits, with the same smoothing, so
+// high values mark novel text and values near zero mark text the corpus predicts.
+func Surprisal(idx *suffixarray.Index, text string, k int, contextLen int) []float64 {
+	lps, _ := logProbs(idx, text, k, contextLen, nil)
+	for i, lp := range lps {
+		lps[i] = -lp / math.Ln2
+	}
+	return lps
+}
+
+// Entropy returns the Shannon entropy, in bits, of the next-byte distribution after
+// context as normalized for scoring: 0 when the next byte is certain, up to 8 when
+// every byte is equally likely. It returns 0 if no suffix of context matches.
+func Entropy(idx *suffixarray.Index, context string, k int) float64 {
+	return EntropyWithConfig(idx, context, k, nil)
+}
+
+// EntropyWithConfig is like Entropy but takes optional settings, such as Config.AddK.
+// A nil cfg behaves like Entropy.
+func EntropyWithConfig(idx *suffixarray.Index, context string, k int, cfg *Config) float64 {
+	sc := newScorer(idx, k, cfg)
+	dist := sc.distribution(context, -1)
+	total := weightSum(dist)
+	var h float64
+	for b := range 256 {
+		if p := sc.prob(dist, total, byte(b)); p > 0 {
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+// corpusAlphabet returns which bytes occur in data and how many distinct ones there are.
+func corpusAlphabet(data []byte) (set [256]bool, size int) {
+	for _, b := range data {
+		if !set[b] {
+			set[b] = true
+			size++
+		}
+	}
+	return set, size
+}
+
+// PerplexityCI computes perplexity on the given text along with a 95% bootstrap
+// confidence interval. Per-position log-probabilities are computed once, then the
+// positions are resampled with replacement resamples times. lo and hi are the 2.5th
+// and 97.5th percentiles of the resampled perplexities; with few positions or
+// resamples they need not bracket ppl.
+func PerplexityCI(idx *suffixarray.Index, text string, k, contextLen, resamples int) (ppl, lo, hi float64) {
+	return PerplexityCIWithConfig(idx, text, k, contextLen, resamples, nil)
+}
+
+// PerplexityCIWithConfig is like PerplexityCI but takes optional settings; bootstrap
+// samples are drawn from cfg.Rand.
+func PerplexityCIWithConfig(idx *suffixarray.Index, text string, k, contextLen, resamples int, cfg *Config) (ppl, lo, hi float64) {
+	lps := cfg.scored(logProbs(idx, text, k, contextLen, cfg))
+	ppl = math.Exp(crossEntropy(lps))
+	if len(lps) == 0 || resamples <= 0 {
+		return ppl, ppl, ppl
+	}
+
+	boot := make([]float64, resamples)
+	for b := range boot {
+		var sum float64
+		for range lps {
+			sum += lps[cfg.intn(len(lps))]
+		}
+		boot[b] = math.Exp(-sum / float64(len(lps)))
+	}
+	sort.Float64s(boot)
+	lo = boot[int(0.025*float64(resamples-1))]
+	hi = boot[int(math.Ceil(0.975*float64(resamples-1)))]
+	return ppl, lo, hi
+}
+
+// SentencePerplexity is the perplexity of a single sentence within a longer text.
+type SentencePerplexity struct {
+	Sentence string
+	Ppl      float64
+}
+
+// PerplexityPerSentence splits text on sentence terminators ('.', '!', '?') and reports
+// the perplexity of each sentence. Each position is still scored with up to contextLen
+// preceding characters, so earlier sentences act as context for later ones. A trailing
+// fragment without a terminator is reported as its own sentence. Whitespace between
+// sentences is context only: it belongs to no sentence and is not scored. A sentence
+// with no scored character, which can only be one made of text[0] alone, is left out.
+func PerplexityPerSentence(idx *suffixarray.Index, text string, k int, contextLen int) []SentencePerplexity {
+	_, logProbs := PerplexityDetailed(idx, text, k, contextLen)
+
+	var result []SentencePerplexity
+	addSentence := func(start, end int) {
+		// Only the reported sentence is scored, not the whitespace around it
+		for start < end && isSpace(text[start]) {
+			start++
+		}
+		for end > start && isSpace(text[end-1]) {
+			end--
+		}
+		if start == end {
+			return
+		}
+		sentence := text[start:end]
+		// logProbs[i-1] scores text[i]; text[0] has no context and is never scored
+		var sum float64
+		var count int
+		for i := max(start, 1); i < end; i++ {
+			sum += logProbs[i-1]
+			count++
+		}
+		if count == 0 {
+			return
+		}
+		result = append(result, SentencePerplexity{sentence, math.Exp(-sum / float64(count))})
+	}
+
+	start := 0
+	for i := 0; i < len(text); i++ {
+		if !isSentenceTerminator(text[i]) {
+			continue
+		}
+		// Keep runs like "?!" or "..." together
+		for i+1 < len(text) && isSentenceTerminator(text[i+1]) {
+			i++
+		}
+		addSentence(start, i+1)
+		start = i + 1
+	}
+	addSentence(start, len(text))
+	return result
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\v' || b == '\f'
+}
+
+func isSentenceTerminator(b byte) bool {
+	return b == '.' || b == '!' || b == '?'
+}
@@ -0,0 +1,456 @@
+package infinigram
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPerplexityCI(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	short := "the cat sat on the log."
+	long := strings.Repeat(short+" ", 10)
+
+	cfg := &Config{Rand: rand.New(rand.NewSource(1))}
+	ppl, lo, hi := PerplexityCIWithConfig(idx, short, 3, 100, 2000, cfg)
+	if want := Perplexity(idx, short, 3, 100); ppl != want {
+		t.Errorf("ppl = %v, want Perplexity's %v", ppl, want)
+	}
+	if !(lo <= ppl && ppl <= hi) {
+		t.Errorf("interval [%v, %v] doesn't contain %v", lo, hi, ppl)
+	}
+
+	// The interval is the bootstrap spread itself: more of the same text narrows it,
+	// and constant scores have none
+	_, loLong, hiLong := PerplexityCIWithConfig(idx, long, 3, 100, 2000, cfg)
+	if hiLong-loLong >= hi-lo {
+		t.Errorf("interval width %v for the long text, %v for the short one", hiLong-loLong, hi-lo)
+	}
+	if ppl, lo, hi := PerplexityCIWithConfig(idx, "aaaa", 3, 100, 100, cfg); lo != ppl || hi != ppl {
+		t.Errorf("constant scores: interval [%v, %v], want the point %v", lo, hi, ppl)
+	}
+}
+
+func TestPerplexityPerSentence(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	text := "the cat sat on the mat. the dog ran?! a zebra"
+	got := PerplexityPerSentence(idx, text, 3, 100)
+	want := []string{"the cat sat on the mat.", "the dog ran?!", "a zebra"}
+	if len(got) != len(want) {
+		t.Fatalf("got %d sentences, want %d: %v", len(got), len(want), got)
+	}
+	for i, sp := range got {
+		if sp.Sentence != want[i] {
+			t.Errorf("sentence %d = %q, want %q", i, sp.Sentence, want[i])
+		}
+		if !(sp.Ppl >= 1) || math.IsInf(sp.Ppl, 0) {
+			t.Errorf("sentence %q has perplexity %v", sp.Sentence, sp.Ppl)
+		}
+	}
+	// A copied sentence is far more predictable than one with an unseen word
+	if got[0].Ppl >= got[2].Ppl {
+		t.Errorf("perplexity %v for a corpus sentence, %v for a novel one", got[0].Ppl, got[2].Ppl)
+	}
+
+	// text[0] is never scored, so a sentence of it alone has no perplexity
+	if got := PerplexityPerSentence(idx, "!", 3, 100); len(got) != 0 {
+		t.Errorf("PerplexityPerSentence(%q) = %v, want no sentences", "!", got)
+	}
+	got = PerplexityPerSentence(idx, "! the cat.", 3, 100)
+	if len(got) != 1 || got[0].Sentence != "the cat." {
+		t.Errorf("PerplexityPerSentence(%q) = %v, want only the second sentence", "! the cat.", got)
+	}
+
+	// The spaces between sentences are not scored with either neighbour
+	text = "the cat.  \n the dog. "
+	_, lps := PerplexityDetailed(idx, text, 3, 100)
+	got = PerplexityPerSentence(idx, text, 3, 100)
+	second := strings.Index(text, "the dog")
+	var sum float64
+	for i := second; i < second+len("the dog."); i++ {
+		sum += lps[i-1]
+	}
+	if want := math.Exp(-sum / float64(len("the dog."))); len(got) != 2 || math.Abs(got[1].Ppl-want) > 1e-9*want {
+		t.Errorf("PerplexityPerSentence(%q) = %v, want %q at %v", text, got, "the dog.", want)
+	}
+}
+
+func TestCrossEntropy(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	text := "the dog sat on the cat. the rat ran."
+	ce := CrossEntropy(idx, text, 3, 100)
+	if ppl := Perplexity(idx, text, 3, 100); math.Abs(math.Exp(ce)-ppl) > 1e-9*ppl {
+		t.Errorf("exp(CrossEntropy) = %v, Perplexity = %v", math.Exp(ce), ppl)
+	}
+	if bpc := BitsPerChar(idx, text, 3, 100); math.Abs(bpc-ce/math.Ln2) > 1e-9*bpc {
+		t.Errorf("BitsPerChar = %v, want %v", bpc, ce/math.Ln2)
+	}
+}
+
+func TestLeaveOneOut(t *testing.T) {
+	unique := "a zebra yawned quietly."
+	corpus := testCorpus + " " + unique + " " + testCorpus
+	idx := newTestIndex(t, corpus)
+	offset := strings.Index(corpus, unique)
+
+	// With only the longest level, the span's one occurrence predicts it perfectly
+	// unless its own position is excluded
+	plain := PerplexityWithConfig(idx, unique, 1, 100, nil)
+	loo := PerplexityWithConfig(idx, unique, 1, 100, &Config{LeaveOneOut: true, TextOffset: offset})
+	if plain > 1.5 {
+		t.Errorf("perplexity of a corpus span = %v, want about 1", plain)
+	}
+	if loo < 2*plain {
+		t.Errorf("perplexity with LeaveOneOut = %v, want well above %v", loo, plain)
+	}
+
+	// Excluding some other position changes nothing
+	elsewhere := PerplexityWithConfig(idx, unique, 1, 100, &Config{LeaveOneOut: true, TextOffset: 0})
+	if math.Abs(elsewhere-plain) > 1e-9*plain {
+		t.Errorf("perplexity excluding the wrong offset = %v, want %v", elsewhere, plain)
+	}
+}
+
+func TestAddK(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	_, alphabet := corpusAlphabet([]byte(testCorpus))
+	// Held out: every byte occurs in the corpus, but with only the longest level some
+	// continuations are unseen and get the floor
+	heldOut := []string{"the rat sat on a dog.", "the log ate a cat.", "the cat dog rat."}
+	for _, text := range heldOut {
+		floored := PerplexityWithConfig(idx, text, 1, 100, nil)
+		smoothed := PerplexityWithConfig(idx, text, 1, 100, &Config{AddK: 0.1})
+		if !(smoothed >= 1) || smoothed > float64(alphabet) {
+			t.Errorf("%q: perplexity with AddK = %v, want between 1 and the alphabet size %d", text, smoothed, alphabet)
+		}
+		if smoothed >= floored {
+			t.Errorf("%q: perplexity with AddK = %v, want below the floored %v", text, smoothed, floored)
+		}
+	}
+
+	// A byte absent from the corpus is floored unless the mass covers all bytes
+	text := "the cat sat on the zoo."
+	floored := PerplexityWithConfig(idx, text, 3, 100, &Config{AddK: 0.1})
+	allBytes := PerplexityWithConfig(idx, text, 3, 100, &Config{AddK: 0.1, AddKAllBytes: true})
+	if allBytes >= floored {
+		t.Errorf("perplexity with AddKAllBytes = %v, want below %v", allBytes, floored)
+	}
+}
+
+func TestPerplexityCache(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	text := strings.Repeat("the cat sat on the mat. the dog ran. ", 20)
+	want := PerplexityWithConfig(idx, text, 3, 10, nil)
+	// A cache of 1 evicts constantly; 1024 holds every context of the text
+	for _, size := range []int{1, 1024} {
+		got := PerplexityWithConfig(idx, text, 3, 10, &Config{CacheSize: size})
+		if math.Abs(got-want) > 1e-9*want {
+			t.Errorf("CacheSize=%d: perplexity %v, want %v", size, got, want)
+		}
+	}
+}
+
+func BenchmarkPerplexityCache(b *testing.B) {
+	idx := newTestIndex(b, strings.Repeat(testCorpus+" ", 100))
+	text := strings.Repeat("the cat sat on the mat. the dog ran after the rat. ", 40)
+	for _, size := range []int{0, 1024} {
+		b.Run(fmt.Sprintf("CacheSize=%d", size), func(b *testing.B) {
+			cfg := &Config{CacheSize: size}
+			for range b.N {
+				PerplexityWithConfig(idx, text, 3, 10, cfg)
+			}
+		})
+	}
+}
+
+func TestEvaluateSkipUnmatched(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	// Nothing in the corpus follows "z" or "q", and neither byte occurs in it
+	text := "the cat sat. zq the dog ran. qz the rat."
+	for _, skip := range []bool{false, true} {
+		ev := Evaluate(idx, text, 3, 100, &Config{SkipUnmatched: skip})
+		if ev.Positions != len(text)-1 {
+			t.Errorf("SkipUnmatched=%v: Positions = %d, want %d", skip, ev.Positions, len(text)-1)
+		}
+		if ev.Unmatched != 4 {
+			t.Errorf("SkipUnmatched=%v: Unmatched = %d, want 4", skip, ev.Unmatched)
+		}
+		if sum := ev.Coverage + float64(ev.Unmatched)/float64(ev.Positions); math.Abs(sum-1) > 1e-12 {
+			t.Errorf("SkipUnmatched=%v: coverage %v and unmatched fraction add up to %v", skip, ev.Coverage, sum)
+		}
+		// Unmatched positions are floored, as are the matched ones predicting "z" or "q"
+		if ev.Floored < ev.Unmatched+2 {
+			t.Errorf("SkipUnmatched=%v: Floored = %d, want at least %d", skip, ev.Floored, ev.Unmatched+2)
+		}
+	}
+
+	lps, matched := logProbs(idx, text, 3, 100, nil)
+	var sum float64
+	var n int
+	for i, lp := range lps {
+		if matched[i] {
+			sum += lp
+			n++
+		}
+	}
+	want := math.Exp(-sum / float64(n))
+	if got := PerplexityWithConfig(idx, text, 3, 100, &Config{SkipUnmatched: true}); math.Abs(got-want) > 1e-9*want {
+		t.Errorf("perplexity over covered positions = %v, want %v", got, want)
+	}
+	if all := Perplexity(idx, text, 3, 100); all <= want {
+		t.Errorf("perplexity with the floor = %v, want above the covered %v", all, want)
+	}
+}
+
+func TestSkipPrefix(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	// The prompt scores terribly, but only conditions the continuation
+	prompt, continuation := "zq the", " cat sat on the mat."
+	text := prompt + continuation
+	_, lps := PerplexityDetailed(idx, text, 3, 100)
+	var sum float64
+	for _, lp := range lps[len(prompt)-1:] {
+		sum += lp
+	}
+	want := math.Exp(-sum / float64(len(continuation)))
+
+	cfg := &Config{SkipPrefix: len(prompt)}
+	if got := PerplexityWithConfig(idx, text, 3, 100, cfg); math.Abs(got-want) > 1e-9*want {
+		t.Errorf("perplexity with SkipPrefix = %v, want %v from the continuation alone", got, want)
+	}
+	if ev := Evaluate(idx, text, 3, 100, cfg); ev.Positions != len(continuation) || ev.Unmatched != 0 {
+		t.Errorf("Evaluate scored %d positions (%d unmatched), want %d (0 unmatched)", ev.Positions, ev.Unmatched, len(continuation))
+	}
+	if all := Perplexity(idx, text, 3, 100); all <= want {
+		t.Errorf("perplexity with the prompt scored = %v, want above %v", all, want)
+	}
+	if got := ScoreContinuation(idx, prompt, continuation, 3, 100); math.Abs(got-sum) > 1e-9*math.Abs(sum) {
+		t.Errorf("ScoreContinuation = %v, want %v", got, sum)
+	}
+}
+
+func TestEvaluateManyMaxOffsetsSharedRand(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	texts := make([]string, 64)
+	for i := range texts {
+		texts[i] = fmt.Sprintf("the cat sat on the mat %d times. the dog ran.", i)
+	}
+	// One Rand shared by every text: reservoir sampling must not draw from it concurrently
+	cfg := &Config{Workers: 4, MaxOffsets: 2, Rand: rand.New(rand.NewSource(1))}
+	ppls := EvaluateManyWithConfig(idx, texts, 3, 100, cfg)
+	if len(ppls) != len(texts) {
+		t.Fatalf("got %d perplexities for %d texts", len(ppls), len(texts))
+	}
+
+	// Scoring sequentially, the draws happen in the same order
+	want := EvaluateManyWithConfig(idx, texts, 3, 100, &Config{MaxOffsets: 2, Rand: rand.New(rand.NewSource(1))})
+	for i := range ppls {
+		// Only map iteration order in combineLevels can differ
+		if math.Abs(ppls[i]-want[i]) > 1e-9*want[i] {
+			t.Errorf("text %d: perplexity %v with Workers, %v without", i, ppls[i], want[i])
+		}
+	}
+}
+
+func TestEvaluateMany(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	texts := []string{"the cat sat.", "a dog ran after the rat.", "", "zq", strings.Repeat("the mat. ", 200)}
+	if ppls := EvaluateMany(idx, texts, 3, 100); len(ppls) != len(texts) {
+		t.Fatalf("EvaluateMany: %d perplexities for %d texts", len(ppls), len(texts))
+	}
+	for _, cfg := range []*Config{nil, {Workers: 4}, {Workers: 4, CacheSize: 64}} {
+		ppls := EvaluateManyWithConfig(idx, texts, 3, 100, cfg)
+		if len(ppls) != len(texts) {
+			t.Fatalf("%d perplexities for %d texts", len(ppls), len(texts))
+		}
+		for i, text := range texts {
+			// Texts too short to score are NaN either way
+			want := Perplexity(idx, text, 3, 100)
+			if got := ppls[i]; math.IsNaN(got) != math.IsNaN(want) || math.Abs(got-want) > 1e-9*want {
+				t.Errorf("text %d: perplexity %v, want Perplexity's %v", i, got, want)
+			}
+		}
+	}
+}
+
+func TestPerplexityVsContext(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	text := "the dog sat on the mat. the cat ran after the dog."
+	lens := []int{1, 2, 4, 8, 100, 4}
+	curve := PerplexityVsContext(idx, text, 3, lens)
+	if len(curve) != 5 {
+		t.Errorf("%d entries for 5 distinct context lengths", len(curve))
+	}
+	for _, n := range lens {
+		got, ok := curve[n]
+		if !ok {
+			t.Errorf("no entry for context length %d", n)
+			continue
+		}
+		if want := Perplexity(idx, text, 3, n); math.Abs(got-want) > 1e-9*want {
+			t.Errorf("context length %d: perplexity %v, want Perplexity's %v", n, got, want)
+		}
+	}
+	// On text this close to the corpus, more context helps
+	if curve[1] <= curve[8] {
+		t.Errorf("perplexity %v with 1 byte of context, want above %v with 8", curve[1], curve[8])
+	}
+}
+
+func TestDistributionsOverText(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	text := "the cat sat. zq the dog"
+	const contextLen = 6
+	// Only map iteration order in combineLevels can differ
+	near := func(a, b float64) bool { return math.Abs(a-b) <= 1e-9*b }
+	dists := DistributionsOverText(idx, text, 3, contextLen)
+	if len(dists) != len(text) {
+		t.Fatalf("%d distributions for %d positions", len(dists), len(text))
+	}
+	for i, dist := range dists {
+		want, _, _ := NextDistribution(idx, text[max(0, i+1-contextLen):i+1], 1, 3)
+		if (dist == nil) != (want == nil) || !maps.EqualFunc(dist, want, near) {
+			t.Errorf("position %d: %v, want NextDistribution's %v", i, dist, want)
+		}
+	}
+
+	// The streaming form visits the same positions in order, and stops when asked
+	var visited []int
+	ForEachDistribution(idx, text, 3, contextLen, func(i int, dist map[byte]float64) bool {
+		visited = append(visited, i)
+		if (dist == nil) != (dists[i] == nil) || !maps.EqualFunc(dist, dists[i], near) {
+			t.Errorf("position %d: streamed %v, returned %v", i, dist, dists[i])
+		}
+		return i < 4
+	})
+	if !slices.Equal(visited, []int{0, 1, 2, 3, 4}) {
+		t.Errorf("visited positions %v, want 0 to 4", visited)
+	}
+}
+
+func TestDistributionsOverTextWithConfig(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	// Long enough for several chunks per worker, with bytes the corpus lacks
+	text := strings.Repeat("the cat sat on the zebra. a dog ran after the rat! ", 40)
+	const contextLen = 20
+	cfg := &Config{AddK: 0.1, Decay: 0.5, Epsilon: 1e-4}
+	dists := DistributionsOverTextWithConfig(idx, text, 3, contextLen, cfg)
+	if len(dists) != len(text) {
+		t.Fatalf("%d distributions for %d positions", len(dists), len(text))
+	}
+	// Each entry gives the next byte the probability scoring does, or nothing if it
+	// was floored
+	lps, _ := logProbs(idx, text, 3, contextLen, cfg)
+	for i, lp := range lps {
+		p, ok := dists[i][text[i+1]]
+		if lp == math.Log(cfg.epsilon()) {
+			if ok {
+				t.Errorf("position %d: floored %q has probability %v", i+1, text[i+1], p)
+			}
+		} else if math.Abs(math.Log(p)-lp) > 1e-9 {
+			t.Errorf("position %d: %q has probability %v, scoring gives %v", i+1, text[i+1], p, math.Exp(lp))
+		}
+	}
+	for i, dist := range dists {
+		var total float64
+		for _, p := range dist {
+			total += p
+		}
+		if math.Abs(total-1) > 1e-9 {
+			t.Errorf("position %d: probabilities sum to %v", i, total)
+		}
+	}
+
+	// Workers compute the same distributions, still streamed in order
+	parallel := *cfg
+	parallel.Workers = 4
+	next := 0
+	ForEachDistributionWithConfig(idx, text, 3, contextLen, &parallel, func(i int, dist map[byte]float64) bool {
+		if i != next {
+			t.Fatalf("position %d streamed after %d", i, next-1)
+		}
+		next++
+		if !maps.EqualFunc(dist, dists[i], func(a, b float64) bool { return math.Abs(a-b) <= 1e-9*b }) {
+			t.Errorf("position %d: %v with workers, %v without", i, dist, dists[i])
+		}
+		return true
+	})
+	if next != len(text) {
+		t.Errorf("streamed %d positions, want %d", next, len(text))
+	}
+}
+
+func TestScoreContinuation(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	context := "the dog ran after "
+	verbatim := "the cat." // what follows in the corpus
+	random := "xjq vwkp"   // same length, bytes the corpus lacks
+	shuffled := "tac. eht" // the same bytes, out of order
+	v := ScoreContinuation(idx, context, verbatim, 3, 100)
+	if r := ScoreContinuation(idx, context, random, 3, 100); v <= r {
+		t.Errorf("verbatim continuation scored %v, random %v", v, r)
+	}
+	if s := ScoreContinuation(idx, context, shuffled, 3, 100); v <= s {
+		t.Errorf("verbatim continuation scored %v, shuffled %v", v, s)
+	}
+	if v > 0 {
+		t.Errorf("log-probability %v, want <= 0", v)
+	}
+	if s := ScoreContinuation(idx, context, "", 3, 100); s != 0 {
+		t.Errorf("empty continuation scored %v, want 0", s)
+	}
+}
+
+func TestSurprisal(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	// Unseen bytes make some positions floored, the rest are ordinary matches
+	text := "the cat sat on the zebra. the dog ran after the rat."
+	_, lps := PerplexityDetailed(idx, text, 3, 100)
+	bits := Surprisal(idx, text, 3, 100)
+	if len(bits) != len(text)-1 || len(bits) != len(lps) {
+		t.Fatalf("%d surprisals for %d scored positions", len(bits), len(lps))
+	}
+	for i, lp := range lps {
+		if want := -lp / math.Ln2; math.Abs(bits[i]-want) > 1e-12*max(1, want) {
+			t.Errorf("position %d: surprisal %v bits, want %v", i+1, bits[i], want)
+		}
+	}
+}
+
+func TestEpsilon(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	// "Z" and "Q" are not in the corpus, so they and the bytes after them, whose
+	// contexts end in an unseen byte, get the floor
+	text := "the cat Zat on the Qat."
+	for _, eps := range []float64{0, 1e-10, 1e-5, 1e-3} {
+		cfg := &Config{Epsilon: eps}
+		want := math.Log(cfg.epsilon())
+		lps, _ := logProbs(idx, text, 3, 100, cfg)
+		z, q := strings.IndexByte(text, 'Z'), strings.IndexByte(text, 'Q')
+		for _, i := range []int{z, z + 1, q, q + 1} {
+			if lps[i-1] != want {
+				t.Errorf("Epsilon %v: log probability of %q is %v, want %v", eps, text[i], lps[i-1], want)
+			}
+		}
+		if ev := Evaluate(idx, text, 3, 100, cfg); ev.Floored != 4 {
+			t.Errorf("Epsilon %v: Evaluate counts %d floored positions, want 4", eps, ev.Floored)
+		}
+	}
+	if cfg := (&Config{Epsilon: 1e-3}); PerplexityWithConfig(idx, text, 3, 100, cfg) >= PerplexityWithConfig(idx, text, 3, 100, nil) {
+		t.Error("a larger Epsilon didn't lower the perplexity of text with unseen bytes")
+	}
+}
+
+func TestPerplexityWorkersMaxOffsets(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	text := strings.Repeat("the cat sat on the mat. the dog ran after the rat. ", 40)
+	got := PerplexityWithConfig(idx, text, 3, 100, &Config{Workers: 4, MaxOffsets: 2, Rand: rand.New(rand.NewSource(1))})
+	want := PerplexityWithConfig(idx, text, 3, 100, &Config{MaxOffsets: 2, Rand: rand.New(rand.NewSource(1))})
+	if math.Abs(got-want) > 1e-9*want {
+		t.Errorf("perplexity %v with Workers, %v without", got, want)
+	}
+}
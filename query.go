@@ -0,0 +1,382 @@
+package infinigram
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"index/suffixarray"
+	"sort"
+)
+
+// sortedSuffixes returns the suffix array of idx: the offsets of every suffix of
+// idx.Bytes() in lexicographic order. index/suffixarray keeps this private, so it is
+// recovered from the index's serialized form (see suffixarray.Index.Write): a
+// fixed-width varint length, the raw data, then chunks that each start with a
+// fixed-width varint byte size followed by uvarint offsets.
+func sortedSuffixes(idx *suffixarray.Index) []int {
+	var buf bytes.Buffer
+	if err := idx.Write(&buf); err != nil {
+		panic(err) // writing to a bytes.Buffer cannot fail
+	}
+	enc := buf.Bytes()
+
+	n64, _ := binary.Varint(enc)
+	n := int(n64)
+	enc = enc[binary.MaxVarintLen64+n:]
+
+	sa := make([]int, 0, n)
+	for len(sa) < n {
+		size, _ := binary.Varint(enc)
+		chunk := enc[binary.MaxVarintLen64:size]
+		for len(chunk) > 0 {
+			off, w := binary.Uvarint(chunk)
+			sa = append(sa, int(off))
+			chunk = chunk[w:]
+		}
+		enc = enc[size:]
+	}
+	return sa
+}
+
+// LongestSuffixMatch returns the length of the longest suffix of context that occurs
+// in the corpus, or 0 if none does. Every shorter suffix of an occurring suffix also
+// occurs, so the length is found by binary search.
+func LongestSuffixMatch(idx *suffixarray.Index, context string) int {
+	return longestSuffixMatchBelow(idx, context, len(context))
+}
+
+// longestSuffixMatchBelow is LongestSuffixMatch for a caller that knows the answer is
+// at most hi. It probes hi first, so when the bound is tight, as it usually is when
+// the context has grown by a byte since the last match, one lookup suffices.
+func longestSuffixMatchBelow(idx *suffixarray.Index, context string, hi int) int {
+	if hi == 0 || len(idx.Lookup([]byte(context[len(context)-hi:]), 1)) > 0 {
+		return hi
+	}
+	lo := 0
+	hi-- // the answer lies in [lo, hi]
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if len(idx.Lookup([]byte(context[len(context)-mid:]), 1)) > 0 {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo
+}
+
+// Count returns how many times s occurs in the corpus, counting overlapping
+// occurrences. The empty string occurs 0 times.
+func Count(idx *suffixarray.Index, s string) int {
+	return len(idx.Lookup([]byte(s), -1))
+}
+
+// ContainsAt returns the corpus offsets at which s occurs, in increasing order, or nil
+// if it doesn't occur.
+func ContainsAt(idx *suffixarray.Index, s string) []int {
+	offsets := idx.Lookup([]byte(s), -1)
+	sort.Ints(offsets)
+	return offsets
+}
+
+// Coverage returns the fraction of positions in text[1:] whose preceding context (up
+// to contextLen characters) has a suffix of at least minN characters in the corpus.
+// It shows how much of an evaluation text the model can say anything about.
+func Coverage(idx *suffixarray.Index, text string, minN, contextLen int) float64 {
+	if len(text) < 2 {
+		return 0
+	}
+	covered := 0
+	for i := 1; i < len(text); i++ {
+		start := max(0, i-contextLen)
+		if LongestSuffixMatch(idx, text[start:i]) >= minN {
+			covered++
+		}
+	}
+	return float64(covered) / float64(len(text)-1)
+}
+
+// LongestRepeatedSubstring returns the longest substring that occurs at least twice in
+// the corpus, and how many times it occurs (occurrences may overlap). It is the longest
+// common prefix of any two adjacent sorted suffixes, computed with Kasai's algorithm in
+// linear time. A long result points at duplicated blocks the model will copy verbatim.
+// It returns "", 0 if no byte repeats.
+func LongestRepeatedSubstring(idx *suffixarray.Index) (string, int) {
+	data := idx.Bytes()
+	sa := sortedSuffixes(idx)
+	rank := make([]int, len(sa))
+	for r, off := range sa {
+		rank[off] = r
+	}
+
+	// Walk suffixes in text order; the LCP with the preceding sorted suffix drops by
+	// at most one from one text position to the next
+	bestLen, bestOff := 0, 0
+	h := 0
+	for off := range data {
+		r := rank[off]
+		if r == 0 {
+			h = 0
+			continue
+		}
+		prev := sa[r-1]
+		for off+h < len(data) && prev+h < len(data) && data[off+h] == data[prev+h] {
+			h++
+		}
+		if h > bestLen {
+			bestLen, bestOff = h, off
+		}
+		if h > 0 {
+			h--
+		}
+	}
+	if bestLen == 0 {
+		return "", 0
+	}
+	substr := string(data[bestOff : bestOff+bestLen])
+	return substr, Count(idx, substr)
+}
+
+// MinimalDeterministicContext returns the length of the shortest suffix of context
+// whose continuations in the corpus are all the same byte (branching factor 1), or -1
+// if no suffix is deterministic. It shows how much context the model needs before the
+// longest level stops leaving any choice.
+func MinimalDeterministicContext(idx *suffixarray.Index, context string) int {
+	data := idx.Bytes()
+	for n := 1; n <= len(context); n++ {
+		offsets := idx.Lookup([]byte(context[len(context)-n:]), -1)
+		if len(offsets) == 0 {
+			// No longer suffix can occur either
+			return -1
+		}
+		next, branches := byte(0), 0
+		for _, off := range offsets {
+			pos := off + n
+			if pos >= len(data) || (branches > 0 && data[pos] == next) {
+				continue
+			}
+			next = data[pos]
+			if branches++; branches > 1 {
+				break
+			}
+		}
+		if branches == 1 {
+			return n
+		}
+	}
+	return -1
+}
+
+// ExpectedMatchLength returns the mean n-gram length behind the combined distribution
+// for context, with each of the k levels weighted by its share of the combined mass
+// (its decay weight times its continuation count). Unlike LongestSuffixMatch it shows
+// how deep the model effectively matches once shorter levels are mixed in. It returns
+// 0 if nothing matches.
+func ExpectedMatchLength(idx *suffixarray.Index, context string, k int) float64 {
+	var cfg *Config // default level weights
+	var sum, mass float64
+	levels := findLevels(idx, context, k, cfg, -1)
+	weights := cfg.levelWeights(levels)
+	for i, lvl := range levels {
+		var count float64
+		for _, c := range lvl.counts {
+			count += c
+		}
+		m := weights[i] * count
+		sum += m * float64(lvl.n)
+		mass += m
+	}
+	if mass == 0 {
+		return 0
+	}
+	return sum / mass
+}
+
+// QueryResult describes a string's occurrences in the corpus.
+type QueryResult struct {
+	Query         string
+	Count         int // occurrences of Query
+	LongestSuffix int // length of the longest suffix of Query that occurs
+	Continuations []Continuation
+}
+
+// Continuation is a byte that follows a query in the corpus.
+type Continuation struct {
+	Next        string
+	Count       int
+	Probability float64
+}
+
+// Query looks s up in the corpus and returns its occurrence count, its longest
+// occurring suffix, and its topK most frequent continuations, most frequent first.
+func Query(idx *suffixarray.Index, s string, topK int) QueryResult {
+	data := idx.Bytes()
+	offsets := idx.Lookup([]byte(s), -1)
+	res := QueryResult{Query: s, Count: len(offsets), LongestSuffix: LongestSuffixMatch(idx, s)}
+
+	var counts [256]int
+	total := 0
+	for _, off := range offsets {
+		if pos := off + len(s); pos < len(data) {
+			counts[data[pos]]++
+			total++
+		}
+	}
+	for b, c := range counts {
+		if c > 0 {
+			res.Continuations = append(res.Continuations, Continuation{string([]byte{byte(b)}), c, float64(c) / float64(total)})
+		}
+	}
+	sort.SliceStable(res.Continuations, func(i, j int) bool {
+		return res.Continuations[i].Count > res.Continuations[j].Count
+	})
+	if len(res.Continuations) > topK {
+		res.Continuations = res.Continuations[:max(topK, 0)]
+	}
+	return res
+}
+
+// CorpusHash returns the hex SHA-256 of data, a stable identifier for tagging results
+// and checking that a cached index was built from the same corpus.
+func CorpusHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// CorpusSummary is a quick overview of a corpus.
+type CorpusSummary struct {
+	Hash          string // see CorpusHash
+	Size          int
+	DistinctBytes int
+	TopBytes      []NgramCount // the 10 most frequent bytes, most frequent first
+	LongestRepeat int          // length of the longest repeated substring
+	RepeatCount   int          // occurrences of that substring
+}
+
+// CorpusStats summarizes the corpus behind idx.
+func CorpusStats(idx *suffixarray.Index) CorpusSummary {
+	_, distinct := corpusAlphabet(idx.Bytes())
+	repeat, count := LongestRepeatedSubstring(idx)
+	return CorpusSummary{
+		Hash:          CorpusHash(idx.Bytes()),
+		Size:          len(idx.Bytes()),
+		DistinctBytes: distinct,
+		TopBytes:      TopNgrams(idx, 1, 10),
+		LongestRepeat: len(repeat),
+		RepeatCount:   count,
+	}
+}
+
+// LevelDump describes one matching suffix of a context: its length, how many
+// continuations it has in the corpus, and the most common continuation.
+type LevelDump struct {
+	N          int
+	NumMatches int
+	TopByte    byte
+	TopCount   int
+}
+
+// DumpLevels returns a LevelDump for every suffix of context that occurs in the corpus,
+// longest first. Unlike BuildDistribution it keeps levels whose match count doesn't
+// increase, which shows what that filter discards. Ties for TopByte go to the
+// smallest byte.
+func DumpLevels(idx *suffixarray.Index, context string) []LevelDump {
+	data := idx.Bytes()
+	var dumps []LevelDump
+	for n := len(context); n > 0; n-- {
+		offsets := idx.Lookup([]byte(context[len(context)-n:]), -1)
+		if len(offsets) == 0 {
+			continue
+		}
+		var counts [256]int
+		d := LevelDump{N: n}
+		for _, off := range offsets {
+			if pos := off + n; pos < len(data) {
+				counts[data[pos]]++
+				d.NumMatches++
+			}
+		}
+		for b, c := range counts {
+			if c > d.TopCount {
+				d.TopByte, d.TopCount = byte(b), c
+			}
+		}
+		dumps = append(dumps, d)
+	}
+	return dumps
+}
+
+// NgramCount is an n-gram and the number of times it occurs in the corpus.
+type NgramCount struct {
+	Ngram string
+	Count int
+}
+
+// TopNgrams returns the topK most frequent length-n substrings of the corpus, most
+// frequent first, with ties broken by byte order. Suffixes sharing the same first n
+// bytes are adjacent in the suffix array, so one pass counts every n-gram and a
+// size-topK min-heap keeps the best.
+func TopNgrams(idx *suffixarray.Index, n, topK int) []NgramCount {
+	if n <= 0 || topK <= 0 {
+		return nil
+	}
+	data := idx.Bytes()
+	h := &ngramHeap{}
+	push := func(start, count int) {
+		if count == 0 {
+			return
+		}
+		nc := NgramCount{string(data[start : start+n]), count}
+		if h.Len() < topK {
+			heap.Push(h, nc)
+		} else if ngramLess((*h)[0], nc) {
+			(*h)[0] = nc
+			heap.Fix(h, 0)
+		}
+	}
+
+	groupStart, groupCount := 0, 0
+	for _, off := range sortedSuffixes(idx) {
+		if off+n > len(data) {
+			continue // too short to hold an n-gram
+		}
+		if groupCount > 0 && bytes.Equal(data[off:off+n], data[groupStart:groupStart+n]) {
+			groupCount++
+			continue
+		}
+		push(groupStart, groupCount)
+		groupStart, groupCount = off, 1
+	}
+	push(groupStart, groupCount)
+
+	result := make([]NgramCount, h.Len())
+	for i := len(result) - 1; i >= 0; i-- {
+		result[i] = heap.Pop(h).(NgramCount)
+	}
+	return result
+}
+
+// ngramLess orders n-grams from least to most frequent; among equal counts the
+// lexicographically larger n-gram ranks lower.
+func ngramLess(a, b NgramCount) bool {
+	if a.Count != b.Count {
+		return a.Count < b.Count
+	}
+	return a.Ngram > b.Ngram
+}
+
+// ngramHeap is a min-heap of n-grams under ngramLess.
+type ngramHeap []NgramCount
+
+func (h ngramHeap) Len() int           { return len(h) }
+func (h ngramHeap) Less(i, j int) bool { return ngramLess(h[i], h[j]) }
+func (h ngramHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *ngramHeap) Push(x any)        { *h = append(*h, x.(NgramCount)) }
+func (h *ngramHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,249 @@
+package infinigram
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTopNgrams(t *testing.T) {
+	idx := newTestIndex(t, "abcabcabxab")
+	got := TopNgrams(idx, 2, 3)
+	want := []NgramCount{{"ab", 4}, {"bc", 2}, {"ca", 2}} // ties in byte order
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("TopNgrams(2, 3) = %v, want %v", got, want)
+	}
+
+	if got := TopNgrams(idx, 3, 1); !reflect.DeepEqual(got, []NgramCount{{"abc", 2}}) {
+		t.Errorf("TopNgrams(3, 1) = %v, want [{abc 2}]", got)
+	}
+	// Asking for more than there are returns them all
+	if got := TopNgrams(idx, 10, 5); len(got) != 2 {
+		t.Errorf("TopNgrams(10, 5) = %v, want the 2 distinct 10-grams", got)
+	}
+	if got := TopNgrams(idx, 12, 5); len(got) != 0 {
+		t.Errorf("TopNgrams longer than the corpus = %v, want none", got)
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	// Mostly corpus text, with a few unknown bytes
+	text := "the cat sat on the log. the dog ate the rat. zz the cat ran."
+	if got := Coverage(idx, text, 1, 100); got != 1-2.0/float64(len(text)-1) {
+		t.Errorf("Coverage with minN 1 = %v, want all but the 2 positions after a z", got)
+	}
+	if long, short := Coverage(idx, text, 8, 100), Coverage(idx, text, 1, 100); long >= short {
+		t.Errorf("Coverage with minN 8 = %v, want below %v", long, short)
+	}
+	if got := Coverage(idx, testCorpus, 1, 100); got != 1 {
+		t.Errorf("Coverage of the corpus = %v, want 1", got)
+	}
+	if got := Coverage(idx, "t", 1, 100); got != 0 {
+		t.Errorf("Coverage of a single byte = %v, want 0", got)
+	}
+}
+
+func TestDumpLevels(t *testing.T) {
+	idx := newTestIndex(t, "abcab abd")
+	// "zab" never occurs; "ab" and "b" each occur 3 times, followed by c, space and d.
+	// The "b" level adds no matches, which BuildDistribution would skip.
+	want := []LevelDump{{N: 2, NumMatches: 3, TopByte: ' ', TopCount: 1}, {N: 1, NumMatches: 3, TopByte: ' ', TopCount: 1}}
+	if got := DumpLevels(idx, "zab"); !slices.Equal(got, want) {
+		t.Errorf("DumpLevels = %+v, want %+v", got, want)
+	}
+
+	// An occurrence at the very end of the corpus has no continuation
+	idx = newTestIndex(t, "abcab")
+	want = []LevelDump{{N: 2, NumMatches: 1, TopByte: 'c', TopCount: 1}, {N: 1, NumMatches: 1, TopByte: 'c', TopCount: 1}}
+	if got := DumpLevels(idx, "ab"); !slices.Equal(got, want) {
+		t.Errorf("DumpLevels at the corpus end = %+v, want %+v", got, want)
+	}
+	if got := DumpLevels(idx, "zz"); len(got) != 0 {
+		t.Errorf("DumpLevels with no match = %+v, want none", got)
+	}
+}
+
+func TestLongestRepeatedSubstring(t *testing.T) {
+	block := "the quick brown fox jumps over the lazy dog"
+	idx := newTestIndex(t, "start. "+block+" middle, "+block+" end.")
+	if s, count := LongestRepeatedSubstring(idx); s != " "+block+" " || count != 2 {
+		t.Errorf("LongestRepeatedSubstring = %q, %d; want %q, 2", s, count, " "+block+" ")
+	}
+
+	// Overlapping occurrences count
+	if s, count := LongestRepeatedSubstring(newTestIndex(t, "aaaa")); s != "aaa" || count != 2 {
+		t.Errorf("in \"aaaa\": %q, %d; want \"aaa\", 2", s, count)
+	}
+	if s, count := LongestRepeatedSubstring(newTestIndex(t, "abcab")); s != "ab" || count != 2 {
+		t.Errorf("in \"abcab\": %q, %d; want \"ab\", 2", s, count)
+	}
+	if s, count := LongestRepeatedSubstring(newTestIndex(t, "abc")); s != "" || count != 0 {
+		t.Errorf("with no repeat: %q, %d; want \"\", 0", s, count)
+	}
+}
+
+func TestCorpusStats(t *testing.T) {
+	idx := newTestIndex(t, "abracadabra")
+	got := CorpusStats(idx)
+	want := CorpusSummary{
+		Hash:          CorpusHash([]byte("abracadabra")),
+		Size:          11,
+		DistinctBytes: 5,
+		TopBytes:      []NgramCount{{"a", 5}, {"b", 2}, {"r", 2}, {"c", 1}, {"d", 1}},
+		LongestRepeat: len("abra"),
+		RepeatCount:   2,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CorpusStats = %+v, want %+v", got, want)
+	}
+}
+
+func TestMinimalDeterministicContext(t *testing.T) {
+	// "c" and "bc" are followed by d and e; only "xbc" pins down d
+	idx := newTestIndex(t, "abcd abce xbcd")
+	for _, tc := range []struct {
+		context string
+		want    int
+	}{
+		{"xbc", 3},
+		{"abc", -1}, // followed by both d and e at every length
+		{"e", 1},
+		{"zbcd", 1}, // the corpus-final "d" has no continuation and doesn't branch
+		{"zq", -1},
+	} {
+		if got := MinimalDeterministicContext(idx, tc.context); got != tc.want {
+			t.Errorf("MinimalDeterministicContext(%q) = %d, want %d", tc.context, got, tc.want)
+		}
+	}
+}
+
+func TestCorpusHash(t *testing.T) {
+	a := []byte(testCorpus)
+	b := []byte(testCorpus)
+	if CorpusHash(a) != CorpusHash(b) {
+		t.Error("identical corpora hash differently")
+	}
+	b[len(b)/2] ^= 1
+	if CorpusHash(a) == CorpusHash(b) {
+		t.Error("corpora differing in one byte hash equally")
+	}
+	if got, want := CorpusHash(nil), "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"; got != want {
+		t.Errorf("CorpusHash of an empty corpus = %s, want the SHA-256 %s", got, want)
+	}
+}
+
+func TestExpectedMatchLength(t *testing.T) {
+	// "ab" occurs twice and "b" three times, so there are two levels: n=2 with weight 1
+	// over 2 continuations and n=1 with weight defaultDecay over 3
+	idx := newTestIndex(t, "xab yab zbc")
+	want := (1*2*2 + defaultDecay*3*1) / (1*2 + defaultDecay*3)
+	if got := ExpectedMatchLength(idx, "ab", -1); math.Abs(got-want) > 1e-12 {
+		t.Errorf("ExpectedMatchLength = %v, want %v", got, want)
+	}
+	if got := ExpectedMatchLength(idx, "ab", 1); got != 2 {
+		t.Errorf("with k=1, ExpectedMatchLength = %v, want 2", got)
+	}
+	if got := ExpectedMatchLength(idx, "q", -1); got != 0 {
+		t.Errorf("with no match, ExpectedMatchLength = %v, want 0", got)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	idx := newTestIndex(t, "abcabcabxab")
+	// The last "ab" ends the corpus, so only three occurrences have a continuation
+	got := Query(idx, "ab", 10)
+	want := QueryResult{Query: "ab", Count: 4, LongestSuffix: 2, Continuations: []Continuation{
+		{Next: "c", Count: 2, Probability: 2.0 / 3},
+		{Next: "x", Count: 1, Probability: 1.0 / 3},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Query(ab) = %+v, want %+v", got, want)
+	}
+	if got := Query(idx, "ab", 1); len(got.Continuations) != 1 || got.Continuations[0].Next != "c" {
+		t.Errorf("Query(ab) with topK 1 kept %+v, want just c", got.Continuations)
+	}
+	if got := Query(idx, "zab", 10); got.Count != 0 || got.LongestSuffix != 2 || len(got.Continuations) != 0 {
+		t.Errorf("Query(zab) = %+v, want no occurrences and a 2-byte suffix match", got)
+	}
+}
+
+func TestLongestSuffixMatchBelow(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	text := "the dog sat on the cat. the rat ate the mat. a zebra ran after the dog."
+	for end := 1; end <= len(text); end++ {
+		context := text[max(0, end-40):end]
+		want := 0
+		for i := 0; i < len(context); i++ { // the naive scan over every suffix
+			if len(idx.Lookup([]byte(context[i:]), 1)) > 0 {
+				want = len(context) - i
+				break
+			}
+		}
+		for hi := want; hi <= len(context); hi++ {
+			if got := longestSuffixMatchBelow(idx, context, hi); got != want {
+				t.Errorf("longestSuffixMatchBelow(%q, %d) = %d, want %d", context, hi, got, want)
+			}
+		}
+		if got := findLevelsFrom(idx, context, len(context), -1, nil, -1); !reflect.DeepEqual(got, findLevels(idx, context, -1, nil, -1)) {
+			t.Errorf("%q: levels differ when the search starts at the full context", context)
+		}
+	}
+}
+
+// BenchmarkIncrementalMatch finds the longest match at each step of a growing text
+// the way generation does, by scanning every suffix, by binary search, and by
+// probing one past the previous step's match.
+func BenchmarkIncrementalMatch(b *testing.B) {
+	idx := newTestIndex(b, strings.Repeat(testCorpus+" ", 500))
+	generated, _ := GenerateWithConfig(idx, "the ", 2000, 0.8, 3, &Config{Rand: rand.New(rand.NewSource(1))})
+	contexts := make([]string, 0, len(generated))
+	for end := 1; end <= len(generated); end++ {
+		contexts = append(contexts, generated[max(0, end-defaultContextWindow):end])
+	}
+	b.Run("scan", func(b *testing.B) {
+		for range b.N {
+			for _, context := range contexts {
+				i := 0
+				for i < len(context) && len(idx.Lookup([]byte(context[i:]), 1)) == 0 {
+					i++
+				}
+			}
+		}
+	})
+	b.Run("binary", func(b *testing.B) {
+		for range b.N {
+			for _, context := range contexts {
+				LongestSuffixMatch(idx, context)
+			}
+		}
+	})
+	b.Run("incremental", func(b *testing.B) {
+		for range b.N {
+			longest := 0
+			for _, context := range contexts {
+				longest = longestSuffixMatchBelow(idx, context, min(len(context), longest+1))
+			}
+		}
+	})
+}
+
+func TestContainsAt(t *testing.T) {
+	idx := newTestIndex(t, "aaaa baaab aa")
+	// Overlapping occurrences all count
+	if got := ContainsAt(idx, "aa"); !slices.Equal(got, []int{0, 1, 2, 6, 7, 11}) {
+		t.Errorf("ContainsAt(aa) = %v, want [0 1 2 6 7 11]", got)
+	}
+	if got := Count(idx, "aa"); got != 6 {
+		t.Errorf("Count(aa) = %d, want 6", got)
+	}
+	if got := ContainsAt(idx, "ab"); !slices.Equal(got, []int{8}) {
+		t.Errorf("ContainsAt(ab) = %v, want [8]", got)
+	}
+	if got := ContainsAt(idx, "abc"); got != nil {
+		t.Errorf("ContainsAt(abc) = %v, want nil", got)
+	}
+}
@@ -0,0 +1,114 @@
+package infinigram
+
+import (
+	"index/suffixarray"
+	"slices"
+	"strings"
+)
+
+// ReverseModel indexes the corpus backwards so that the usual next-byte machinery
+// predicts the byte that precedes a context instead of the one that follows it.
+type ReverseModel struct {
+	Index *suffixarray.Index // suffix array over the reversed corpus
+}
+
+// NewReverseModel indexes a reversed copy of corpus.
+func NewReverseModel(corpus []byte) *ReverseModel {
+	reversed := slices.Clone(corpus)
+	slices.Reverse(reversed)
+	return &ReverseModel{Index: suffixarray.New(reversed)}
+}
+
+// GenerateBackward extends prompt to the left until the result is maxChars long (or no
+// match remains) and returns the full text, prompt included, in normal reading order.
+// Stats describe the matches against the reversed corpus, as for GenerateWithConfig.
+func (m *ReverseModel) GenerateBackward(prompt string, maxChars int, temp float64, k int, cfg *Config) (string, []LevelStats) {
+	reversed, stats := GenerateWithConfig(m.Index, reverseString(prompt), maxChars, temp, k, cfg)
+	return reverseString(reversed), stats
+}
+
+// reverseString reverses s byte by byte.
+func reverseString(s string) string {
+	b := []byte(s)
+	slices.Reverse(b)
+	return string(b)
+}
+
+// infillOverlap is how many bytes the forward and backward generations must share
+// before InfillBetween joins them.
+const infillOverlap = 8
+
+// InfillBetween generates text to bridge left and right by meeting in the middle: it
+// extends left forward with idx and right backward with rev, one byte at a time each,
+// until the tail of the forward text (up to infillOverlap bytes) also appears in the
+// backward text. The two are then spliced at that overlap. It returns the bridging
+// text and true, or the forward text alone and false if they haven't met after
+// maxChars bytes of generation in total.
+func InfillBetween(idx *suffixarray.Index, rev *ReverseModel, left, right string, maxChars int, temp float64, k int, cfg *Config) (string, bool) {
+	forward := []byte(left)
+	backward := []byte(reverseString(right)) // grows at the end, read reversed
+
+	for generated := 0; ; generated++ {
+		if fill, ok := splice(string(forward), reverseString(string(backward)), len(left), len(right)); ok {
+			return fill, true
+		}
+		if generated >= maxChars {
+			break
+		}
+		// Alternate sides so both get a chance to reach the other
+		side := &forward
+		model := idx
+		if generated%2 == 1 {
+			side, model = &backward, rev.Index
+		}
+		ch, ok := nextByte(model, string(cfg.context(*side)), temp, k, cfg)
+		if !ok {
+			// This side is stuck; let the other one keep going
+			side, model = &backward, rev.Index
+			if generated%2 == 1 {
+				side, model = &forward, idx
+			}
+			if ch, ok = nextByte(model, string(cfg.context(*side)), temp, k, cfg); !ok {
+				break
+			}
+		}
+		*side = append(*side, ch)
+	}
+	return string(forward[len(left):]), false
+}
+
+// splice joins the forward text (left plus its extension) and the backward text (an
+// extension plus right) if the forward text's tail occurs in the backward text, or if
+// either side has already reached the other's fixed context on its own. It returns
+// the text between left and right in the joined result.
+func splice(forward, backward string, leftLen, rightLen int) (string, bool) {
+	left, right := forward[:leftLen], backward[len(backward)-rightLen:]
+	if ext := forward[leftLen:]; len(ext) >= rightLen && strings.HasSuffix(ext, right) {
+		return ext[:len(ext)-rightLen], true
+	}
+	if ext := backward[:len(backward)-rightLen]; len(ext) >= leftLen && strings.HasPrefix(ext, left) {
+		return ext[leftLen:], true
+	}
+
+	tail := forward[len(forward)-min(infillOverlap, len(forward)):]
+	if tail == "" {
+		return "", false
+	}
+	for from := 0; ; {
+		i := strings.Index(backward[from:], tail)
+		if i < 0 {
+			return "", false
+		}
+		joined := forward + backward[from+i+len(tail):]
+		if len(joined) >= leftLen+rightLen {
+			return joined[leftLen : len(joined)-rightLen], true
+		}
+		from += i + 1
+	}
+}
+
+// nextByte samples the byte following context, reporting false if nothing matches.
+func nextByte(idx *suffixarray.Index, context string, temp float64, k int, cfg *Config) (byte, bool) {
+	dist, _, _ := BuildDistribution(idx, context, k, cfg)
+	return sampleWeighted(dist, temp, cfg)
+}
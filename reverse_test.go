@@ -0,0 +1,65 @@
+package infinigram
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestGenerateBackward(t *testing.T) {
+	m := NewReverseModel([]byte(testCorpus))
+	// "on the log." occurs once, so greedy longest-match generation recovers what
+	// precedes it in the corpus
+	want := "the dog sat on the log."
+	text, _ := m.GenerateBackward("on the log.", len(want), 0, 1, nil)
+	if text != want {
+		t.Errorf("GenerateBackward = %q, want %q", text, want)
+	}
+
+	// Sampled with only the longest level, each new byte is one that precedes the
+	// longest matching prefix of the text to its right, so the whole prompt here
+	for seed := range int64(20) {
+		text, _ = m.GenerateBackward(" sat on", 40, 0.8, 1, &Config{Rand: rand.New(rand.NewSource(seed))})
+		if !strings.HasSuffix(text, " sat on") || len(text) != 40 {
+			t.Fatalf("seed %d: GenerateBackward = %q, want 40 bytes ending with the prompt", seed, text)
+		}
+		if tail := text[len(text)-len(" sat on")-1:]; !strings.Contains(testCorpus, tail) {
+			t.Errorf("seed %d: GenerateBackward = %q, but %q isn't in the corpus", seed, text, tail)
+		}
+		for i := 0; i+2 <= len(text); i++ {
+			if !strings.Contains(testCorpus, text[i:i+2]) {
+				t.Errorf("seed %d: GenerateBackward = %q, but %q isn't in the corpus", seed, text, text[i:i+2])
+			}
+		}
+	}
+}
+
+func TestInfillBetween(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	rev := NewReverseModel([]byte(testCorpus))
+	// Both sides occur once, with "a cat and a dog" between them
+	fill, ok := InfillBetween(idx, rev, "log. ", " sat on a mat.", 40, 0, 1, nil)
+	if !ok || fill != "a cat and a dog" {
+		t.Errorf("InfillBetween = %q, %v; want %q, true", fill, ok, "a cat and a dog")
+	}
+
+	// Sampled sides usually meet, and never produce more than was generated
+	met := 0
+	for seed := range int64(20) {
+		cfg := &Config{Rand: rand.New(rand.NewSource(seed))}
+		fill, ok := InfillBetween(idx, rev, "the dog ", " the cat.", 60, 0.8, 3, cfg)
+		if ok {
+			met++
+			if len(fill) > 60 {
+				t.Errorf("seed %d: InfillBetween = %q, longer than the 60 bytes generated", seed, fill)
+			}
+		}
+	}
+	if met < 10 {
+		t.Errorf("sides met for %d of 20 seeds, want most", met)
+	}
+
+	if _, ok := InfillBetween(idx, rev, "zq", "qz", 20, 0.8, 3, nil); ok {
+		t.Error("InfillBetween with unmatched contexts reported success")
+	}
+}
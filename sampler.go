@@ -0,0 +1,46 @@
+package infinigram
+
+import (
+	"index/suffixarray"
+	"math/rand"
+)
+
+// Sampler draws from one index with its own random source and scratch space. A Sampler
+// is not safe for concurrent use, but any number of Samplers can share an index, so
+// concurrent generation gives each goroutine its own.
+type Sampler struct {
+	idx *suffixarray.Index
+	cfg Config
+	// dist is reused by every Sample call and every step of Generate
+	dist map[byte]float64
+}
+
+// NewSampler returns a Sampler over idx with a copy of cfg (nil for the defaults)
+// whose Rand is replaced by a source seeded with seed. OutputCounts is dropped, since
+// a map shared between Samplers would race.
+func NewSampler(idx *suffixarray.Index, cfg *Config, seed int64) *Sampler {
+	s := &Sampler{idx: idx, dist: make(map[byte]float64)}
+	if cfg != nil {
+		s.cfg = *cfg
+	}
+	s.cfg.Rand = rand.New(rand.NewSource(seed))
+	s.cfg.OutputCounts = nil
+	s.cfg.scratch = s.dist
+	return s
+}
+
+// Sample draws the byte following context from k n-gram levels. It reports false if
+// no suffix of the context matches.
+func (s *Sampler) Sample(context string, temp float64, k int) (byte, bool) {
+	dist, _, _ := combineLevelsInto(s.dist, findLevels(s.idx, context, k, &s.cfg, -1), &s.cfg)
+	if dist == nil {
+		return 0, false
+	}
+	return sampleWeighted(dist, temp, &s.cfg)
+}
+
+// Generate is GenerateWithConfig using the Sampler's settings, random source and
+// scratch space.
+func (s *Sampler) Generate(prompt string, maxChars int, temp float64, k int) (string, []LevelStats) {
+	return generate(s.idx, prompt, maxChars, temp, k, &s.cfg, nil)
+}
@@ -0,0 +1,81 @@
+package infinigram
+
+import (
+	"math"
+	"sort"
+)
+
+// NStats holds summary statistics over a set of integer observations,
+// such as n-gram lengths or match counts collected during generation.
+type NStats struct {
+	Mean, Variance, Std, Median float64
+	P10, P90                    int
+}
+
+// Stats computes the mean, population variance, standard deviation, median, and the
+// 10th/90th percentiles of vals. The median of an even-length slice is the average of
+// the two middle values; percentiles follow Percentile. An empty slice yields the zero NStats.
+func Stats(vals []int) NStats {
+	if len(vals) == 0 {
+		return NStats{}
+	}
+	var sum int
+	for _, v := range vals {
+		sum += v
+	}
+	mean := float64(sum) / float64(len(vals))
+	var varSum float64
+	for _, v := range vals {
+		varSum += (float64(v) - mean) * (float64(v) - mean)
+	}
+	variance := varSum / float64(len(vals))
+
+	sorted := make([]int, len(vals))
+	copy(sorted, vals)
+	sort.Ints(sorted)
+	var median float64
+	if len(sorted)%2 == 0 {
+		median = float64(sorted[len(sorted)/2-1]+sorted[len(sorted)/2]) / 2
+	} else {
+		median = float64(sorted[len(sorted)/2])
+	}
+	return NStats{
+		Mean:     mean,
+		Variance: variance,
+		Std:      math.Sqrt(variance),
+		Median:   median,
+		P10:      nearestRank(sorted, 10),
+		P90:      nearestRank(sorted, 90),
+	}
+}
+
+// Percentile returns the p-th percentile (0 <= p <= 100) of vals using the nearest-rank
+// method: the smallest value such that at least p percent of vals are less than or equal
+// to it. The result is always an element of vals; an empty slice yields 0.
+func Percentile(vals []int, p float64) int {
+	sorted := make([]int, len(vals))
+	copy(sorted, vals)
+	sort.Ints(sorted)
+	return nearestRank(sorted, p)
+}
+
+// nearestRank is Percentile on an already sorted slice.
+func nearestRank(sorted []int, p float64) int {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[min(max(rank, 1), len(sorted))-1]
+}
+
+// histogram counts occurrences of each value; hist[v] is the number of times v appears in vals.
+func histogram(vals []int) []int {
+	var hist []int
+	for _, v := range vals {
+		for len(hist) <= v {
+			hist = append(hist, 0)
+		}
+		hist[v]++
+	}
+	return hist
+}
@@ -0,0 +1,65 @@
+package infinigram
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	for _, tc := range []struct {
+		vals                   []int
+		mean, variance, median float64
+	}{
+		{nil, 0, 0, 0},
+		{[]int{5}, 5, 0, 5},
+		{[]int{3, 1, 2}, 2, 2.0 / 3, 2},            // odd: the middle value
+		{[]int{4, 1, 3, 2}, 2.5, 1.25, 2.5},        // even: the mean of the middle two
+		{[]int{2, 4, 4, 4, 5, 5, 7, 9}, 5, 4, 4.5}, // population std 2
+	} {
+		s := Stats(tc.vals)
+		if s.Mean != tc.mean || math.Abs(s.Variance-tc.variance) > 1e-12 || s.Median != tc.median {
+			t.Errorf("Stats(%v) = mean %v, variance %v, median %v; want %v, %v, %v",
+				tc.vals, s.Mean, s.Variance, s.Median, tc.mean, tc.variance, tc.median)
+		}
+		if math.Abs(s.Std-math.Sqrt(tc.variance)) > 1e-12 {
+			t.Errorf("Stats(%v).Std = %v, want %v", tc.vals, s.Std, math.Sqrt(tc.variance))
+		}
+	}
+
+	vals := []int{3, 1, 2}
+	Stats(vals)
+	if vals[0] != 3 || vals[1] != 1 || vals[2] != 2 {
+		t.Errorf("Stats reordered its input to %v", vals)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	hundred := make([]int, 100)
+	for i := range hundred {
+		hundred[i] = 100 - i // 100 down to 1
+	}
+	for _, tc := range []struct {
+		vals []int
+		p    float64
+		want int
+	}{
+		{hundred, 0, 1},
+		{hundred, 10, 10},
+		{hundred, 50, 50},
+		{hundred, 90, 90},
+		{hundred, 99.5, 100},
+		{hundred, 100, 100},
+		{[]int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 25, 3}, // the 2.5th value rounds up
+		{[]int{7, 7, 7}, 50, 7},
+		{[]int{42}, 10, 42},
+		{nil, 50, 0},
+	} {
+		if got := Percentile(tc.vals, tc.p); got != tc.want {
+			t.Errorf("Percentile(%d values, %v) = %d, want %d", len(tc.vals), tc.p, got, tc.want)
+		}
+	}
+
+	if s := Stats(hundred); s.P10 != 10 || s.P90 != 90 {
+		t.Errorf("Stats P10, P90 = %d, %d, want 10, 90", s.P10, s.P90)
+	}
+}
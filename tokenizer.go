@@ -0,0 +1,153 @@
+package infinigram
+
+import (
+	"slices"
+	"sort"
+)
+
+// Tokenizer converts between raw corpus bytes and a sequence of integer token IDs.
+// Decode(Encode(b)) must reproduce b.
+type Tokenizer interface {
+	Encode([]byte) []int
+	Decode([]int) []byte
+}
+
+// ByteTokenizer maps every byte to its own token ID in [0, 256). It matches the
+// byte-level behavior of the suffixarray-based functions.
+type ByteTokenizer struct{}
+
+// Encode returns one token per byte.
+func (ByteTokenizer) Encode(b []byte) []int {
+	tokens := make([]int, len(b))
+	for i, c := range b {
+		tokens[i] = int(c)
+	}
+	return tokens
+}
+
+// Decode returns one byte per token. Tokens outside [0, 256) are truncated to a byte.
+func (ByteTokenizer) Decode(tokens []int) []byte {
+	b := make([]byte, len(tokens))
+	for i, t := range tokens {
+		b[i] = byte(t)
+	}
+	return b
+}
+
+// TokenIndex is a suffix array over a token sequence, the []int analog of
+// suffixarray.Index for corpora encoded by a Tokenizer.
+type TokenIndex struct {
+	tokens []int
+	sa     []int
+}
+
+// NewTokenIndex builds a TokenIndex over the given tokens.
+func NewTokenIndex(tokens []int) *TokenIndex {
+	return &TokenIndex{tokens: tokens, sa: suffixArray(tokens)}
+}
+
+// suffixArray returns the offsets of every suffix of tokens in lexicographic order, a
+// shorter suffix sorting before any longer one it prefixes. It uses prefix doubling:
+// once suffixes are ranked by their first h tokens, ranking each by the pair (its
+// rank, the rank of the suffix h tokens later) orders them by their first 2h tokens.
+// Each round is two counting sorts, so the build takes O(n log n) time however
+// repetitive the tokens are.
+func suffixArray(tokens []int) []int {
+	n := len(tokens)
+	sa, rank, tmp := make([]int, n), make([]int, n), make([]int, n)
+	count := make([]int, n+1)
+	// sortByRank stably counting-sorts order by rank into sa
+	sortByRank := func(order []int) {
+		clear(count)
+		for _, i := range order {
+			count[rank[i]+1]++
+		}
+		for r := 1; r < len(count); r++ {
+			count[r] += count[r-1]
+		}
+		for _, i := range order {
+			sa[count[rank[i]]] = i
+			count[rank[i]]++
+		}
+	}
+
+	// Rank by the first token, compacted to [0, distinct tokens)
+	values := slices.Clone(tokens)
+	slices.Sort(values)
+	values = slices.Compact(values)
+	for i, t := range tokens {
+		rank[i], _ = slices.BinarySearch(values, t)
+		tmp[i] = i
+	}
+	sortByRank(tmp)
+	classes := len(values)
+
+	for h := 1; classes < n; h *= 2 {
+		// Order by the second half: suffixes with nothing h tokens later come first,
+		// then the rest in the order of the suffix h tokens later, which sa holds
+		tmp = tmp[:0]
+		for i := n - h; i < n; i++ {
+			tmp = append(tmp, i)
+		}
+		for _, i := range sa {
+			if i >= h {
+				tmp = append(tmp, i-h)
+			}
+		}
+		sortByRank(tmp)
+
+		second := func(i int) int {
+			if i+h < n {
+				return rank[i+h]
+			}
+			return -1
+		}
+		tmp[sa[0]] = 0
+		classes = 1
+		for j := 1; j < n; j++ {
+			a, b := sa[j-1], sa[j]
+			if rank[a] != rank[b] || second(a) != second(b) {
+				classes++
+			}
+			tmp[b] = classes - 1
+		}
+		rank, tmp = tmp, rank
+	}
+	return sa
+}
+
+// NewTokenIndexFrom encodes corpus with tok and builds a TokenIndex over the result.
+func NewTokenIndexFrom(tok Tokenizer, corpus []byte) *TokenIndex {
+	return NewTokenIndex(tok.Encode(corpus))
+}
+
+// Tokens returns the indexed token sequence. It must not be modified.
+func (x *TokenIndex) Tokens() []int {
+	return x.tokens
+}
+
+// Lookup returns the unsorted list of offsets at which query occurs in the token
+// sequence. An empty query matches nothing.
+func (x *TokenIndex) Lookup(query []int) []int {
+	if len(query) == 0 {
+		return nil
+	}
+	prefixCmp := func(off int) int {
+		suffix := x.tokens[off:]
+		return slices.Compare(suffix[:min(len(suffix), len(query))], query)
+	}
+	lo := sort.Search(len(x.sa), func(i int) bool { return prefixCmp(x.sa[i]) >= 0 })
+	hi := lo + sort.Search(len(x.sa)-lo, func(i int) bool { return prefixCmp(x.sa[lo+i]) > 0 })
+	return slices.Clone(x.sa[lo:hi])
+}
+
+// Continuations counts the tokens that immediately follow each occurrence of context.
+func (x *TokenIndex) Continuations(context []int) map[int]int {
+	counts := make(map[int]int)
+	for _, off := range x.Lookup(context) {
+		if pos := off + len(context); pos < len(x.tokens) {
+			counts[x.tokens[pos]]++
+		}
+	}
+	return counts
+}
@@ -0,0 +1,161 @@
+package infinigram
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestByteTokenizerRoundTrip(t *testing.T) {
+	var tok ByteTokenizer
+	for _, s := range []string{"", "a", testCorpus, "\x00\xff\xfe", "héllo, 世界"} {
+		tokens := tok.Encode([]byte(s))
+		if len(tokens) != len(s) {
+			t.Errorf("Encode(%q) gave %d tokens, want one per byte", s, len(tokens))
+		}
+		if got := tok.Decode(tokens); !bytes.Equal(got, []byte(s)) {
+			t.Errorf("Decode(Encode(%q)) = %q", s, got)
+		}
+	}
+}
+
+// naiveSuffixArray sorts suffixes by comparing them directly.
+func naiveSuffixArray(tokens []int) []int {
+	sa := make([]int, len(tokens))
+	for i := range sa {
+		sa[i] = i
+	}
+	sort.Slice(sa, func(i, j int) bool {
+		return slices.Compare(tokens[sa[i]:], tokens[sa[j]:]) < 0
+	})
+	return sa
+}
+
+func TestSuffixArray(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	cases := [][]int{nil, {7}, {3, 3, 3, 3, 3}, {-5, 1 << 40, 0, -5, 1 << 40}}
+	for range 200 {
+		tokens := make([]int, r.Intn(60))
+		alphabet := 1 + r.Intn(4)
+		for i := range tokens {
+			tokens[i] = r.Intn(alphabet) * 1000
+		}
+		cases = append(cases, tokens)
+	}
+	for _, tokens := range cases {
+		if got, want := suffixArray(tokens), naiveSuffixArray(tokens); !slices.Equal(got, want) {
+			t.Fatalf("suffixArray(%v) = %v, want %v", tokens, got, want)
+		}
+	}
+}
+
+func TestTokenIndexLookup(t *testing.T) {
+	x := NewTokenIndexFrom(ByteTokenizer{}, []byte(testCorpus))
+	idx := newTestIndex(t, testCorpus)
+	for _, q := range []string{"the", "cat", "t", "the cat sat", "zebra"} {
+		got := x.Lookup(ByteTokenizer{}.Encode([]byte(q)))
+		want := idx.Lookup([]byte(q), -1)
+		slices.Sort(got)
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			t.Errorf("Lookup(%q) = %v, want %v", q, got, want)
+		}
+	}
+}
+
+func TestTokenModelMatchesByteModel(t *testing.T) {
+	idx := newTestIndex(t, testCorpus)
+	m := NewTokenModel(ByteTokenizer{}, []byte(testCorpus))
+	for _, context := range []string{"the c", "sat on the ", "a dog", "zz", ""} {
+		for _, k := range []int{-1, 0, 1, 3} {
+			want, wantN, wantM := BuildDistribution(idx, context, k, nil)
+			got, gotN, gotM := m.BuildDistribution(ByteTokenizer{}.Encode([]byte(context)), k, nil)
+			if len(got) != len(want) || !slices.Equal(gotN, wantN) || !slices.Equal(gotM, wantM) {
+				t.Fatalf("context %q, k=%d: levels %v %v, want %v %v", context, k, gotN, gotM, wantN, wantM)
+			}
+			for b, w := range want {
+				if math.Abs(got[int(b)]-w) > 1e-12 {
+					t.Errorf("context %q, k=%d: weight of %q is %v, want %v", context, k, b, got[int(b)], w)
+				}
+			}
+		}
+	}
+
+	text := "the cat sat on the log. the rat ran."
+	if got, want := m.Perplexity(text, 3, 50, nil), Perplexity(idx, text, 3, 50); math.Abs(got-want) > 1e-9*want {
+		t.Errorf("Perplexity = %v, want %v", got, want)
+	}
+
+	// Greedy decoding picks the same byte at every step
+	want, _ := Generate(idx, "the d", 60, 0, 3)
+	if got := m.Generate("the d", 55, 0, 3, nil); got != want {
+		t.Errorf("Generate = %q, want %q", got, want)
+	}
+}
+
+// wordTokenizer makes each word and each space a token, to test TokenModel with
+// tokens longer than a byte.
+type wordTokenizer struct {
+	ids   map[string]int
+	words []string
+}
+
+func (w *wordTokenizer) Encode(b []byte) []int {
+	var tokens []int
+	for i, word := range strings.Split(string(b), " ") {
+		if i > 0 {
+			tokens = append(tokens, w.id(" "))
+		}
+		if word != "" {
+			tokens = append(tokens, w.id(word))
+		}
+	}
+	return tokens
+}
+
+func (w *wordTokenizer) Decode(tokens []int) []byte {
+	var sb strings.Builder
+	for _, t := range tokens {
+		sb.WriteString(w.words[t])
+	}
+	return []byte(sb.String())
+}
+
+func (w *wordTokenizer) id(word string) int {
+	if id, ok := w.ids[word]; ok {
+		return id
+	}
+	w.ids[word] = len(w.words)
+	w.words = append(w.words, word)
+	return w.ids[word]
+}
+
+func TestTokenModelWords(t *testing.T) {
+	tok := &wordTokenizer{ids: make(map[string]int)}
+	m := NewTokenModel(tok, []byte(testCorpus))
+	text := m.Generate("the dog", 20, 0.8, 3, &Config{Rand: rand.New(rand.NewSource(1))})
+	if !strings.HasPrefix(text, "the dog") || len(text) <= len("the dog") {
+		t.Fatalf("Generate = %q, want the prompt and more", text)
+	}
+	corpusWords := strings.Fields(testCorpus)
+	for _, word := range strings.Fields(text) {
+		if !slices.Contains(corpusWords, word) {
+			t.Errorf("generated %q, which isn't a corpus word", word)
+		}
+	}
+	if ppl := m.Perplexity("the cat sat on the mat.", 3, 10, nil); !(ppl >= 1) || math.IsInf(ppl, 0) {
+		t.Errorf("Perplexity = %v, want a finite value >= 1", ppl)
+	}
+}
+
+func BenchmarkNewTokenIndex(b *testing.B) {
+	// A repetitive corpus, where comparison-sorting suffixes is slowest
+	tokens := ByteTokenizer{}.Encode(bytes.Repeat([]byte("abcabcabd"), 20000))
+	for range b.N {
+		NewTokenIndex(tokens)
+	}
+}
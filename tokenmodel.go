@@ -0,0 +1,155 @@
+package infinigram
+
+import (
+	"math"
+	"slices"
+)
+
+// TokenModel is an infini-gram model over the token stream of a Tokenizer rather than
+// raw bytes: levels are suffixes of the context counted in tokens, and it samples and
+// scores whole tokens. With ByteTokenizer it matches the byte-level functions.
+//
+// Of the Config settings it honors those that don't depend on bytes: Rand, Decay,
+// LevelWeights, ExtendLevelWeights, MinMatches, MaxMatchThreshold, ContextWindow
+// (counted in tokens) and Epsilon. The rest apply only to the byte-level model.
+type TokenModel struct {
+	tok Tokenizer
+	idx *TokenIndex
+}
+
+// NewTokenModel encodes corpus with tok and indexes the tokens.
+func NewTokenModel(tok Tokenizer, corpus []byte) *TokenModel {
+	return &TokenModel{tok: tok, idx: NewTokenIndexFrom(tok, corpus)}
+}
+
+// Index returns the token index the model samples from.
+func (m *TokenModel) Index() *TokenIndex {
+	return m.idx
+}
+
+// BuildDistribution is BuildDistribution over tokens: the unnormalized distribution
+// of the token after context, and the n (in tokens) and match count of each level.
+// It returns nil if no suffix of context occurs.
+func (m *TokenModel) BuildDistribution(context []int, k int, cfg *Config) (map[int]float64, []int, []int) {
+	var combined map[int]float64
+	var nValues, matchCounts []int
+	lastNumMatches := 0
+	for n := m.idx.longestSuffixMatch(context); n > 0 && (k <= 0 || len(nValues) < k); n-- {
+		counts := m.idx.Continuations(context[len(context)-n:])
+		numMatches := 0
+		for _, c := range counts {
+			numMatches += c
+		}
+		if numMatches <= lastNumMatches || cfg.tooRare(numMatches) {
+			continue
+		}
+		if k == 0 && cfg.tooGeneric(numMatches) && len(nValues) > 0 {
+			break
+		}
+		if combined == nil {
+			combined = make(map[int]float64)
+		}
+		w := cfg.levelWeight(len(nValues))
+		for t, c := range counts {
+			combined[t] += w * float64(c)
+		}
+		nValues = append(nValues, n)
+		matchCounts = append(matchCounts, numMatches)
+		lastNumMatches = numMatches
+	}
+	return combined, nValues, matchCounts
+}
+
+// Generate encodes prompt, extends it by up to maxTokens sampled tokens, and decodes
+// the result, prompt included. It stops early if no suffix of the context occurs.
+// A temp <= 0 takes the highest-weighted token, the smallest on ties.
+func (m *TokenModel) Generate(prompt string, maxTokens int, temp float64, k int, cfg *Config) string {
+	tokens := m.tok.Encode([]byte(prompt))
+	for range maxTokens {
+		context := tokens
+		if w := cfg.contextWindow(); w > 0 && len(context) > w {
+			context = context[len(context)-w:]
+		}
+		dist, _, _ := m.BuildDistribution(context, k, cfg)
+		t, ok := sampleToken(dist, temp, cfg)
+		if !ok {
+			break
+		}
+		tokens = append(tokens, t)
+	}
+	return string(m.tok.Decode(tokens))
+}
+
+// Perplexity is Perplexity per token: text is encoded and every token after the first
+// is scored with up to contextLen preceding tokens as context. Unseen tokens get
+// cfg.Epsilon, as in PerplexityWithConfig.
+func (m *TokenModel) Perplexity(text string, k, contextLen int, cfg *Config) float64 {
+	tokens := m.tok.Encode([]byte(text))
+	var logProbSum float64
+	for i := 1; i < len(tokens); i++ {
+		dist, _, _ := m.BuildDistribution(tokens[max(0, i-contextLen):i], k, cfg)
+		var total float64
+		for _, w := range dist {
+			total += w
+		}
+		p := cfg.epsilon()
+		if total > 0 && dist[tokens[i]] > 0 {
+			p = dist[tokens[i]] / total
+		}
+		logProbSum += math.Log(p)
+	}
+	return math.Exp(-logProbSum / float64(len(tokens)-1))
+}
+
+// sampleToken is sampleWeighted for tokens: it applies temperature to dist (in place)
+// and draws a token, reporting false if dist is empty.
+func sampleToken(dist map[int]float64, temp float64, cfg *Config) (int, bool) {
+	var peak float64
+	for _, w := range dist {
+		peak = max(peak, w)
+	}
+	if peak <= 0 {
+		return 0, false
+	}
+	tokens := make([]int, 0, len(dist))
+	for t := range dist {
+		tokens = append(tokens, t)
+	}
+	slices.Sort(tokens)
+	if !(temp > 0) {
+		best := tokens[0]
+		for _, t := range tokens[1:] {
+			if dist[t] > dist[best] {
+				best = t
+			}
+		}
+		return best, true
+	}
+
+	var total float64
+	for _, t := range tokens {
+		dist[t] = math.Pow(dist[t]/peak, 1/temp)
+		total += dist[t]
+	}
+	r := cfg.float64() * total
+	for _, t := range tokens {
+		if r -= dist[t]; r < 0 {
+			return t, true
+		}
+	}
+	return tokens[len(tokens)-1], true
+}
+
+// longestSuffixMatch is LongestSuffixMatch over tokens.
+func (x *TokenIndex) longestSuffixMatch(context []int) int {
+	lo, hi := 0, len(context)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if len(x.Lookup(context[len(context)-mid:])) > 0 {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo
+}
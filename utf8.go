@@ -0,0 +1,98 @@
+package infinigram
+
+import "unicode/utf8"
+
+// utf8State tracks where generated text stands within a UTF-8 encoding, so that only
+// bytes keeping it a valid UTF-8 prefix are emitted (see Config.ValidUTF8).
+type utf8State struct {
+	need   int  // continuation bytes still missing from the current rune
+	lo, hi byte // range of the next continuation byte
+}
+
+// newUTF8State returns the state after text. Only an incomplete rune at the end of
+// text matters; earlier invalid bytes are ignored.
+func newUTF8State(text []byte) utf8State {
+	var s utf8State
+	start := max(0, len(text)-utf8.UTFMax+1)
+	for i := len(text) - 1; i >= start; i-- {
+		if utf8.RuneStart(text[i]) {
+			for _, b := range text[i:] {
+				if !s.allows(b) {
+					return utf8State{}
+				}
+				s.push(b)
+			}
+			break
+		}
+	}
+	return s
+}
+
+// allows reports whether b can come next.
+func (s utf8State) allows(b byte) bool {
+	if s.need > 0 {
+		return s.lo <= b && b <= s.hi
+	}
+	return b < utf8.RuneSelf || 0xC2 <= b && b <= 0xF4
+}
+
+// allowed returns the bytes that can come next as a lookup table.
+func (s utf8State) allowed() *[256]bool {
+	var set [256]bool
+	for b := range set {
+		set[b] = s.allows(byte(b))
+	}
+	return &set
+}
+
+// push advances the state past b, which must be allowed.
+func (s *utf8State) push(b byte) {
+	if s.need > 0 {
+		s.need--
+		s.lo, s.hi = 0x80, 0xBF
+		return
+	}
+	s.lo, s.hi = 0x80, 0xBF
+	switch {
+	case b < utf8.RuneSelf:
+	case b < 0xE0:
+		s.need = 1
+	case b < 0xF0:
+		s.need = 2
+		if b == 0xE0 {
+			s.lo = 0xA0 // no overlong encodings
+		} else if b == 0xED {
+			s.hi = 0x9F // no surrogates
+		}
+	default:
+		s.need = 3
+		if b == 0xF0 {
+			s.lo = 0x90 // no overlong encodings
+		} else if b == 0xF4 {
+			s.hi = 0x8F // nothing past U+10FFFF
+		}
+	}
+}
+
+// validPrefix returns the longest prefix of run that can follow s.
+func (s utf8State) validPrefix(run []byte) []byte {
+	for i, b := range run {
+		if !s.allows(b) {
+			return run[:i]
+		}
+		s.push(b)
+	}
+	return run
+}
+
+// runeStart returns the first rune boundary in text at or after start, so that a
+// context window doesn't begin in the middle of a rune. It gives up after
+// utf8.UTFMax bytes, as invalid text may have no boundary nearby.
+func runeStart(text []byte, start int) int {
+	for i := start; i < len(text) && i < start+utf8.UTFMax; i++ {
+		if utf8.RuneStart(text[i]) {
+			return i
+		}
+	}
+	return start
+}
@@ -22,11 +22,11 @@ TEMP = 0.8
 
 
 def generate_infinigram(target_chars: int) -> tuple[str, float]:
-    """Run infini-gram.go and return (output, generation_time)."""
+    """Run the Go infini-gram and return (output, generation_time)."""
     import re
 
     result = subprocess.run(
-        ["go", "run", "infini-gram.go"],
+        ["go", "run", "./cmd/infini-gram"],
         capture_output=True,
         text=True,
         cwd=os.path.dirname(os.path.abspath(__file__)),